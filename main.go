@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/plugin"
 
@@ -8,6 +10,19 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-state":
+			os.Exit(rollgcp.MigrateState(os.Args[2:], os.Stdout, os.Stderr))
+		case "roll":
+			os.Exit(rollgcp.Roll(os.Args[2:], os.Stdout, os.Stderr))
+		case "status":
+			os.Exit(rollgcp.RolloutStatus(os.Args[2:], os.Stdout, os.Stderr))
+		case "abort":
+			os.Exit(rollgcp.AbortRollout(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	plugin.Serve(&plugin.ServeOpts{
 		ProviderFunc: func() *schema.Provider {
 			return rollgcp.Provider()
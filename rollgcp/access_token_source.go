@@ -0,0 +1,134 @@
+package rollgcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/oauth2"
+)
+
+// How long an access token that does not say when it expires is used before
+// it is read again. Google access tokens last an hour, but nothing tells how
+// much of that hour is left when the token is read; gcloud only refreshes its
+// cached token once less than about four minutes are left.
+const accessTokenAssumedLifetime = 3 * time.Minute
+
+// How long an access_token_command may run.
+const accessTokenCommandTimeout = time.Minute
+
+// externalAccessTokenSource reads access tokens from a command or a file
+// every time the last one expires, so that rollouts outlive any one token.
+type externalAccessTokenSource struct {
+	ctx     context.Context
+	command string
+	path    string
+}
+
+// Token implements the oauth2.TokenSource interface method.
+func (ts *externalAccessTokenSource) Token() (*oauth2.Token, error) {
+	var output []byte
+	var err error
+	if ts.command != "" {
+		output, err = ts.runCommand()
+		if err != nil {
+			return nil, fmt.Errorf("Error running access_token_command: %s", err)
+		}
+	} else {
+		path, err := homedir.Expand(ts.path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading access_token_file: %s", err)
+		}
+		if output, err = ioutil.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("Error reading access_token_file: %s", err)
+		}
+	}
+
+	token, err := parseAccessToken(output)
+	if err != nil {
+		if ts.command != "" {
+			return nil, fmt.Errorf("Error reading the output of access_token_command: %s", err)
+		}
+		return nil, fmt.Errorf("Error reading access_token_file %s: %s", ts.path, err)
+	}
+	log.Printf("[DEBUG] Read a new access token, used until %s", token.Expiry.Format(time.RFC3339))
+	return token, nil
+}
+
+func (ts *externalAccessTokenSource) runCommand() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ts.ctx, accessTokenCommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", ts.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", ts.command)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseAccessToken reads a token printed either bare, as by gcloud auth
+// print-access-token, or as a JSON object with access_token and optionally
+// expires_in or expiry (RFC 3339), as returned by token endpoints.
+func parseAccessToken(output []byte) (*oauth2.Token, error) {
+	text := strings.TrimSpace(string(output))
+	if text == "" {
+		return nil, fmt.Errorf("no access token")
+	}
+
+	if !strings.HasPrefix(text, "{") {
+		if strings.ContainsAny(text, " \t\r\n") {
+			return nil, fmt.Errorf("expected a single access token")
+		}
+		return &oauth2.Token{
+			AccessToken: text,
+			TokenType:   "Bearer",
+			Expiry:      time.Now().Add(accessTokenAssumedLifetime),
+		}, nil
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Expiry      string `json:"expiry"`
+	}
+	if err := json.Unmarshal([]byte(text), &resp); err != nil {
+		return nil, err
+	}
+	if resp.AccessToken == "" {
+		return nil, fmt.Errorf("no access_token field")
+	}
+
+	token := &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   resp.TokenType,
+		Expiry:      time.Now().Add(accessTokenAssumedLifetime),
+	}
+	switch {
+	case resp.ExpiresIn > 0:
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	case resp.Expiry != "":
+		expiry, err := time.Parse(time.RFC3339, resp.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", resp.Expiry)
+		}
+		token.Expiry = expiry
+	}
+	return token, nil
+}
@@ -0,0 +1,130 @@
+package rollgcp
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+// serviceClientCache holds the API service clients of a Config, one per kind
+// of client and user agent, since building one is not free and a rollout
+// asks for them constantly. Service clients are safe for concurrent use.
+type serviceClientCache struct {
+	lock    sync.Mutex
+	clients map[string]interface{}
+}
+
+func newServiceClientCache() *serviceClientCache {
+	return &serviceClientCache{
+		clients: make(map[string]interface{}),
+	}
+}
+
+// get returns the client of the given kind for userAgent, building it with
+// newClient on first use. Clients that fail to build are not cached.
+func (c *serviceClientCache) get(kind, userAgent string, newClient func() interface{}) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := kind + "\x00" + userAgent
+	if client, ok := c.clients[key]; ok {
+		return client
+	}
+	client := newClient()
+	if client != nil {
+		c.clients[key] = client
+	}
+	return client
+}
+
+// How long a node pool read is reused. Changes made through this provider
+// invalidate it straight away; this bounds how stale changes made elsewhere,
+// such as by the cluster autoscaler, can appear.
+const nodePoolCacheTTL = 30 * time.Second
+
+// nodePoolCache is a read-through cache of NodePools.Get, keyed by the node
+// pool's fully qualified name. The node pool is read many times over the
+// steps of a rollout while it only changes when the provider changes it.
+type nodePoolCache struct {
+	lock  sync.Mutex
+	pools map[string]cachedNodePool
+}
+
+type cachedNodePool struct {
+	// raw is the node pool in JSON, so that every caller gets its own copy
+	// to modify.
+	raw     []byte
+	fetched time.Time
+}
+
+func newNodePoolCache() *nodePoolCache {
+	return &nodePoolCache{
+		pools: make(map[string]cachedNodePool),
+	}
+}
+
+func (c *nodePoolCache) get(name string) *containerBeta.NodePool {
+	c.lock.Lock()
+	cached, ok := c.pools[name]
+	c.lock.Unlock()
+	if !ok || time.Since(cached.fetched) > nodePoolCacheTTL {
+		return nil
+	}
+
+	var nodePool containerBeta.NodePool
+	if err := json.Unmarshal(cached.raw, &nodePool); err != nil {
+		return nil
+	}
+	return &nodePool
+}
+
+func (c *nodePoolCache) store(name string, nodePool *containerBeta.NodePool) {
+	raw, err := json.Marshal(nodePool)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pools[name] = cachedNodePool{raw: raw, fetched: time.Now()}
+}
+
+func (c *nodePoolCache) invalidate(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pools, name)
+}
+
+// getNodePool reads the node pool with the fully qualified name, from the
+// cache if it was read recently.
+func (c *Config) getNodePool(name, project, userAgent string) (*containerBeta.NodePool, error) {
+	if nodePool := c.nodePools.get(name); nodePool != nil {
+		log.Printf("[TRACE] Using cached NodePool %s", name)
+		return nodePool, nil
+	}
+	return c.refreshNodePool(name, project, userAgent)
+}
+
+// refreshNodePool reads the node pool with the fully qualified name from the
+// API and caches it, for callers that wait on the node pool to change.
+func (c *Config) refreshNodePool(name, project, userAgent string) (*containerBeta.NodePool, error) {
+	clusterNodePoolsGetCall := c.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Get(name)
+	if c.UserProjectOverride {
+		clusterNodePoolsGetCall.Header().Add("X-Goog-User-Project", project)
+	}
+	nodePool, err := clusterNodePoolsGetCall.Do()
+	if err != nil {
+		c.nodePools.invalidate(name)
+		return nil, err
+	}
+	c.nodePools.store(name, nodePool)
+	return nodePool, nil
+}
+
+// invalidateNodePool drops the cached read of the node pool with the fully
+// qualified name. Everything that changes a node pool must call it.
+func (c *Config) invalidateNodePool(name string) {
+	c.nodePools.invalidate(name)
+}
@@ -0,0 +1,558 @@
+package rollgcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/terraform-provider-google-beta/version"
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+// The phase recorded for a rollout that was abandoned with the abort command.
+const rolloutPhaseAborted = "aborted"
+
+// rolloutStateFile records the progress of a rollout started with the roll
+// command, so that an interrupted run can be resumed.
+type rolloutStateFile struct {
+	Project  string `json:"project"`
+	Location string `json:"location"`
+	Cluster  string `json:"cluster"`
+	Pool     string `json:"pool"`
+
+	Desired              *containerBeta.NodePool `json:"desired"`
+	MaxSurgeNodes        int64                   `json:"max_surge_nodes"`
+	MaxUnavailableNodes  int64                   `json:"max_unavailable_nodes"`
+	PinnedWorkloadPolicy string                  `json:"pinned_workload_policy"`
+
+	Phase     string    `json:"phase"`
+	PID       int       `json:"pid"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+	LastError string    `json:"last_error,omitempty"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// loadRolloutStateFile reads the state file at path. It returns nil if there
+// is no such file.
+func loadRolloutStateFile(path string) (*rolloutStateFile, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading state file %s: %s", path, err)
+	}
+
+	state := &rolloutStateFile{path: path}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("Error parsing state file %s: %s", path, err)
+	}
+	return state, nil
+}
+
+// save writes the state file, replacing it atomically.
+func (s *rolloutStateFile) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Updated = time.Now()
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("Error writing state file %s: %s", tmp, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("Error writing state file %s: %s", s.path, err)
+	}
+	return nil
+}
+
+func (s *rolloutStateFile) finished() bool {
+	return s.Phase == rolloutPhaseDone || s.Phase == rolloutPhaseAborted
+}
+
+// running reports whether the process that last recorded the state is still
+// alive.
+func (s *rolloutStateFile) running() bool {
+	if s.PID == 0 || s.PID == os.Getpid() {
+		return false
+	}
+	process, err := os.FindProcess(s.PID)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+func (s *rolloutStateFile) matches(t *rolloutCommandTarget) bool {
+	return s.Project == t.project && s.Location == t.location && s.Cluster == t.cluster && s.Pool == t.pool
+}
+
+// rolloutCommandTarget holds the flags shared by the rollout commands.
+type rolloutCommandTarget struct {
+	project     string
+	location    string
+	cluster     string
+	pool        string
+	credentials string
+	stateFile   string
+	verbose     bool
+}
+
+func newRolloutCommandFlags(name string, stderr io.Writer) (*flag.FlagSet, *rolloutCommandTarget) {
+	t := &rolloutCommandTarget{}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&t.project, "project", os.Getenv("GOOGLE_PROJECT"), "The project of the cluster. Defaults to $GOOGLE_PROJECT.")
+	flags.StringVar(&t.location, "location", "", "The location (region or zone) of the cluster.")
+	flags.StringVar(&t.cluster, "cluster", "", "The name of the cluster.")
+	flags.StringVar(&t.pool, "pool", "", "The name of the node pool.")
+	flags.StringVar(&t.credentials, "credentials", os.Getenv("GOOGLE_CREDENTIALS"), "A service account key file or its contents. Defaults to $GOOGLE_CREDENTIALS, then to application default credentials.")
+	flags.StringVar(&t.stateFile, "state-file", "", "The file recording the rollout's progress. Defaults to rollgcp-<cluster>-<pool>.json.")
+	flags.BoolVar(&t.verbose, "verbose", false, "Log debug output.")
+	return flags, t
+}
+
+// parse parses args and checks the target flags. It returns the exit code to
+// use if parsing failed.
+func (t *rolloutCommandTarget) parse(flags *flag.FlagSet, args []string) (int, bool) {
+	if err := flags.Parse(args); err != nil {
+		return 2, false
+	}
+	if t.project == "" || t.location == "" || t.cluster == "" || t.pool == "" || flags.NArg() != 0 {
+		fmt.Fprintf(flags.Output(), "-project, -location, -cluster and -pool are required\n")
+		flags.Usage()
+		return 2, false
+	}
+	if t.stateFile == "" {
+		t.stateFile = fmt.Sprintf("rollgcp-%s-%s.json", t.cluster, t.pool)
+	}
+	log.SetFlags(log.LstdFlags)
+	log.SetOutput(&commandLogWriter{w: flags.Output(), verbose: t.verbose})
+	return 0, true
+}
+
+func (t *rolloutCommandTarget) nodePoolInfo() *NodePoolInformation {
+	return &NodePoolInformation{
+		project:  t.project,
+		location: t.location,
+		cluster:  t.cluster,
+	}
+}
+
+// newRollout sets up the same rollout engine the resource uses.
+func (t *rolloutCommandTarget) newRollout(ctx context.Context, settings *rolloutSettings, timeout time.Duration) (*nodePoolRollout, error) {
+	config := &Config{
+		Project:     t.project,
+		Credentials: t.credentials,
+		Telemetry:   expandProviderTelemetrySettings(nil),
+		userAgent:   fmt.Sprintf("terraform-provider-rollgcp/%s (roll command)", version.ProviderVersion),
+	}
+	ConfigureBasePaths(config)
+	if err := config.LoadAndValidate(ctx); err != nil {
+		return nil, err
+	}
+
+	return newNodePoolRollout(config, t.nodePoolInfo(), t.pool, config.userAgent, settings, timeout)
+}
+
+// commandLogWriter prints the provider's log lines, dropping debug output
+// unless verbose is set.
+type commandLogWriter struct {
+	w       io.Writer
+	verbose bool
+}
+
+func (l *commandLogWriter) Write(p []byte) (int, error) {
+	if !l.verbose && (bytes.Contains(p, []byte("[DEBUG]")) || bytes.Contains(p, []byte("[TRACE]"))) {
+		return len(p), nil
+	}
+	return l.w.Write(p)
+}
+
+// Roll implements the roll command, which rolls a node pool outside of
+// Terraform with the rollout engine of the resource. Its progress is recorded
+// in a state file; running it again with the same state file resumes an
+// interrupted rollout. It returns the process exit code.
+func Roll(args []string, stdout, stderr io.Writer) int {
+	flags, target := newRolloutCommandFlags("roll", stderr)
+	machineType := flags.String("machine-type", "", "The new machine type of the nodes.")
+	imageType := flags.String("image-type", "", "The new image type of the nodes.")
+	diskSizeGb := flags.Int64("disk-size-gb", 0, "The new boot disk size of the nodes, in GB.")
+	nodeCount := flags.Int64("node-count", -1, "The new number of nodes per zone. Defaults to the current size.")
+	maxSurgeNodes := flags.Int64("max-surge-nodes", 1, "The number of nodes per zone the destination pool may grow by ahead of the drained nodes.")
+	maxUnavailableNodes := flags.Int64("max-unavailable-nodes", 0, "The number of nodes per zone that may be drained ahead of the destination pool growing.")
+	pinnedWorkloadPolicy := flags.String("pinned-workload-policy", pinnedWorkloadPolicyFail, `What to do about workloads pinned to the node pool, "fail" or "relabel".`)
+	timeout := flags.Duration("timeout", 2*time.Hour, "How long the rollout may take.")
+	dryRun := flags.Bool("dry-run", false, "Print the steps the rollout would take without taking them.")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: terraform-provider-rollgcp roll -project=... -location=... -cluster=... -pool=... [options]\n")
+		flags.PrintDefaults()
+	}
+	if code, ok := target.parse(flags, args); !ok {
+		return code
+	}
+
+	state, err := loadRolloutStateFile(target.stateFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	resuming := state != nil && !state.finished()
+	if resuming {
+		if !state.matches(target) {
+			fmt.Fprintf(stderr, "State file %s belongs to NodePool %s of cluster %s; use another -state-file\n", target.stateFile, state.Pool, state.Cluster)
+			return 1
+		}
+		if state.running() {
+			fmt.Fprintf(stderr, "The rollout recorded in %s is still running as process %d\n", target.stateFile, state.PID)
+			return 1
+		}
+		if *dryRun {
+			fmt.Fprintf(stderr, "The rollout recorded in %s is unfinished; a dry run can only plan a new rollout\n", target.stateFile)
+			return 1
+		}
+		fmt.Fprintf(stderr, "Resuming the rollout of NodePool %s at phase %s; the options describing the new node pool are ignored\n", state.Pool, state.Phase)
+	} else {
+		state = &rolloutStateFile{
+			Project:              target.project,
+			Location:             target.location,
+			Cluster:              target.cluster,
+			Pool:                 target.pool,
+			MaxSurgeNodes:        *maxSurgeNodes,
+			MaxUnavailableNodes:  *maxUnavailableNodes,
+			PinnedWorkloadPolicy: *pinnedWorkloadPolicy,
+			Phase:                rolloutPhaseMoveToTemporary,
+			Started:              time.Now(),
+			path:                 target.stateFile,
+		}
+	}
+	if state.MaxSurgeNodes+state.MaxUnavailableNodes == 0 {
+		fmt.Fprintf(stderr, "At least one of -max-surge-nodes and -max-unavailable-nodes must be greater than 0\n")
+		return 2
+	}
+	if state.PinnedWorkloadPolicy != pinnedWorkloadPolicyFail && state.PinnedWorkloadPolicy != pinnedWorkloadPolicyRelabel {
+		fmt.Fprintf(stderr, "-pinned-workload-policy must be %q or %q\n", pinnedWorkloadPolicyFail, pinnedWorkloadPolicyRelabel)
+		return 2
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := &rolloutSettings{
+		maxSurgeNodes:       state.MaxSurgeNodes,
+		maxUnavailableNodes: state.MaxUnavailableNodes,
+	}
+	rollout, err := target.newRollout(ctx, settings, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	rollout.pinnedWorkloadPolicy = state.PinnedWorkloadPolicy
+
+	if !resuming {
+		current, err := rollout.getNodePool(target.pool)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		size, _, err := rollout.nodePoolSize(target.pool)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if *nodeCount >= 0 {
+			size = *nodeCount
+		}
+		state.Desired = rolloutDesiredNodePool(current, size, *machineType, *imageType, *diskSizeGb)
+	}
+
+	if *dryRun {
+		steps, err := rollout.plan(state.Desired)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		for _, step := range steps {
+			fmt.Fprintln(stdout, step)
+		}
+		return 0
+	}
+
+	// The Lease outlives an interrupted rollout, so that it can be released
+	// once the rollout has stopped.
+	leaseKube := *rollout.kube
+	leaseKube.context = context.Background()
+	releaseLease, err := clusterRolloutLeases.acquire(rollout.nodePoolInfo.lockKey(), &leaseKube)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer releaseLease()
+
+	state.PID = os.Getpid()
+	state.LastError = ""
+	if err := state.save(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	rollout.onPhase = func(phase string) error {
+		fmt.Fprintf(stderr, "Rollout of NodePool %s entering phase %s\n", state.Pool, phase)
+		state.Phase = phase
+		return state.save()
+	}
+
+	// An interrupt cancels the rollout's context, which stops it at its next
+	// API call or wait. A second interrupt kills the process.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupts:
+			signal.Stop(interrupts)
+			close(interrupted)
+			cancel()
+		case <-stopped:
+		}
+	}()
+
+	err = rollout.resume(state.Desired, state.Phase)
+	signal.Stop(interrupts)
+	close(stopped)
+
+	for _, warning := range rollout.warnings {
+		fmt.Fprintf(stderr, "Warning: %s\n", warning)
+	}
+	if err != nil {
+		select {
+		case <-interrupted:
+			log.Printf("[DEBUG] Rollout of NodePool %s stopped: %s", state.Pool, err)
+			state.LastError = "interrupted"
+			state.save()
+			fmt.Fprintf(stderr, "Interrupted at phase %s; run roll again with -state-file=%s to resume, or abort to roll back\n", state.Phase, state.path)
+			return 130
+		default:
+		}
+		state.LastError = err.Error()
+		state.save()
+		fmt.Fprintf(stderr, "Rollout of NodePool %s failed at phase %s: %s\n", state.Pool, state.Phase, err)
+		fmt.Fprintf(stderr, "Run roll again with -state-file=%s to resume, or abort to roll back\n", state.path)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "NodePool %s has been rolled\n", state.Pool)
+	return 0
+}
+
+// rolloutDesiredNodePool builds the node pool to roll to from the live one,
+// dropping the fields the API sets itself and applying the requested changes.
+func rolloutDesiredNodePool(current *containerBeta.NodePool, size int64, machineType, imageType string, diskSizeGb int64) *containerBeta.NodePool {
+	desired := *current
+	desired.Conditions = nil
+	desired.InstanceGroupUrls = nil
+	desired.PodIpv4CidrSize = 0
+	desired.SelfLink = ""
+	desired.Status = ""
+	desired.StatusMessage = ""
+	desired.InitialNodeCount = size
+
+	nodeConfig := containerBeta.NodeConfig{}
+	if current.Config != nil {
+		nodeConfig = *current.Config
+	}
+	if machineType != "" {
+		nodeConfig.MachineType = machineType
+	}
+	if imageType != "" {
+		nodeConfig.ImageType = imageType
+	}
+	if diskSizeGb > 0 {
+		nodeConfig.DiskSizeGb = diskSizeGb
+	}
+	desired.Config = &nodeConfig
+
+	return &desired
+}
+
+// RolloutStatus implements the status command, which prints the recorded
+// progress of a rollout and the live state of the node pools involved. It
+// returns the process exit code.
+func RolloutStatus(args []string, stdout, stderr io.Writer) int {
+	flags, target := newRolloutCommandFlags("status", stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: terraform-provider-rollgcp status -project=... -location=... -cluster=... -pool=... [options]\n")
+		flags.PrintDefaults()
+	}
+	if code, ok := target.parse(flags, args); !ok {
+		return code
+	}
+
+	state, err := loadRolloutStateFile(target.stateFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if state == nil {
+		fmt.Fprintf(stdout, "No rollout recorded in %s\n", target.stateFile)
+	} else {
+		fmt.Fprintf(stdout, "Rollout of NodePool %s in cluster %s (%s, %s)\n", state.Pool, state.Cluster, state.Project, state.Location)
+		fmt.Fprintf(stdout, "  phase:   %s\n", state.Phase)
+		fmt.Fprintf(stdout, "  started: %s\n", state.Started.Format(time.RFC3339))
+		fmt.Fprintf(stdout, "  updated: %s\n", state.Updated.Format(time.RFC3339))
+		if state.running() {
+			fmt.Fprintf(stdout, "  running: process %d\n", state.PID)
+		}
+		if state.LastError != "" {
+			fmt.Fprintf(stdout, "  error:   %s\n", state.LastError)
+		}
+	}
+
+	rollout, err := target.newRollout(context.Background(), &rolloutSettings{}, time.Minute)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	for _, pool := range []string{target.pool, rollout.temporaryName()} {
+		size, exists, err := rollout.nodePoolSize(pool)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if !exists {
+			fmt.Fprintf(stdout, "NodePool %s: not found\n", pool)
+			continue
+		}
+
+		nodes, err := rollout.listNodePoolNodes(pool)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		var ready, cordoned int
+		for i := range nodes {
+			if nodes[i].IsReady() {
+				ready++
+			}
+			if nodes[i].Spec.Unschedulable {
+				cordoned++
+			}
+		}
+		fmt.Fprintf(stdout, "NodePool %s: %d nodes per zone, %d nodes registered, %d ready, %d cordoned\n", pool, size, len(nodes), ready, cordoned)
+	}
+
+	lease, err := rollout.kube.GetLease(rolloutLeaseNamespace, rolloutLeaseName)
+	switch {
+	case isKubernetesApiErrorWithCode(err, 404):
+		fmt.Fprintf(stdout, "Lease %s/%s: not held\n", rolloutLeaseNamespace, rolloutLeaseName)
+	case err != nil:
+		fmt.Fprintln(stderr, err)
+		return 1
+	case lease.expiry().Before(time.Now()):
+		fmt.Fprintf(stdout, "Lease %s/%s: lapsed, last held by %s\n", rolloutLeaseNamespace, rolloutLeaseName, lease.Spec.HolderIdentity)
+	default:
+		fmt.Fprintf(stdout, "Lease %s/%s: held by %s until %s\n", rolloutLeaseNamespace, rolloutLeaseName, lease.Spec.HolderIdentity, lease.expiry().Format(time.RFC3339))
+	}
+
+	return 0
+}
+
+// AbortRollout implements the abort command, which rolls back a rollout that
+// has not yet deleted the original node pool: the original nodes are
+// uncordoned and the temporary node pool is deleted. It returns the process
+// exit code.
+func AbortRollout(args []string, stdout, stderr io.Writer) int {
+	flags, target := newRolloutCommandFlags("abort", stderr)
+	timeout := flags.Duration("timeout", 30*time.Minute, "How long the abort may take.")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: terraform-provider-rollgcp abort -project=... -location=... -cluster=... -pool=... [options]\n")
+		flags.PrintDefaults()
+	}
+	if code, ok := target.parse(flags, args); !ok {
+		return code
+	}
+
+	state, err := loadRolloutStateFile(target.stateFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if state == nil || state.finished() || !state.matches(target) {
+		fmt.Fprintf(stderr, "No unfinished rollout of NodePool %s recorded in %s\n", target.pool, target.stateFile)
+		return 1
+	}
+	if state.running() {
+		fmt.Fprintf(stderr, "The rollout is still running as process %d; interrupt it first\n", state.PID)
+		return 1
+	}
+	if state.Phase != rolloutPhaseMoveToTemporary {
+		fmt.Fprintf(stderr, "The rollout is at phase %s and the original node pool is gone, so it cannot be rolled back; run roll to finish it\n", state.Phase)
+		return 1
+	}
+
+	rollout, err := target.newRollout(context.Background(), &rolloutSettings{}, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	releaseLease, err := clusterRolloutLeases.acquire(rollout.nodePoolInfo.lockKey(), rollout.kube)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer releaseLease()
+
+	nodes, err := rollout.listNodePoolNodes(state.Pool)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	names := []string{}
+	for i := range nodes {
+		names = append(names, nodes[i].Metadata.Name)
+		if !nodes[i].Spec.Unschedulable {
+			continue
+		}
+		log.Printf("[INFO] Uncordoning node %s", nodes[i].Metadata.Name)
+		if err := rollout.kube.SetNodeUnschedulable(nodes[i].Metadata.Name, false); err != nil {
+			fmt.Fprintf(stderr, "Error uncordoning node %s: %s\n", nodes[i].Metadata.Name, err)
+			return 1
+		}
+	}
+	if err := rollout.setDrainingTaint(names, false); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if err := rollout.deleteNodePool(rollout.temporaryName()); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	state.Phase = rolloutPhaseAborted
+	state.PID = os.Getpid()
+	if err := state.save(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Rollout of NodePool %s has been rolled back\n", state.Pool)
+	return 0
+}
@@ -3,12 +3,13 @@ package rollgcp
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
 	"time"
 
-	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/logging"
 	"google.golang.org/api/option"
 
@@ -30,28 +31,60 @@ type providerMeta struct {
 type Config struct {
 	Credentials         string
 	AccessToken         string
+	AccessTokenCommand  string
+	AccessTokenFile     string
 	Project             string
 	BillingProject      string
 	Region              string
 	Zone                string
 	Scopes              []string
 	BatchingConfig      *batchingConfig
+	RetrySettings       *retrySettings
+	RateLimits          *rateLimitSettings
+	Telemetry           *telemetrySettings
+	MetricsTextfilePath string
+	HTTPProxy           string
+	CABundle            string
 	UserProjectOverride bool
 	RequestTimeout      time.Duration
-	// PollInterval is passed to resource.StateChangeConf in common_operation.go
-	// It controls the interval at which we poll for successful operations
-	PollInterval time.Duration
+	// DryRun makes node pool updates report the steps they would take
+	// instead of taking them.
+	DryRun bool
+	// MaxConcurrentPoolRollouts is the number of node pools of a cluster
+	// that may be rolled at the same time.
+	MaxConcurrentPoolRollouts int
+	// PollInterval is the initial interval at which we poll for successful
+	// operations. It doubles after every poll, up to PollMaxInterval.
+	PollInterval    time.Duration
+	PollMaxInterval time.Duration
+	// ImpersonateServiceAccount, if set, is the service account whose
+	// tokens are used, generated with the configured credentials.
+	ImpersonateServiceAccount          string
+	ImpersonateServiceAccountDelegates []string
 
 	client    *http.Client
 	context   context.Context
 	userAgent string
 
 	tokenSource oauth2.TokenSource
+	tracer      *tracer
+	metrics     *metricsRegistry
+
+	// baseTransport is where requests to Google APIs go out, through the
+	// configured proxy and CA bundle.
+	baseTransport *http.Transport
 
 	ComputeBasePath       string
 	ComputeBetaBasePath   string
 	ContainerBasePath     string
 	ContainerBetaBasePath string
+	// The base paths of the APIs that tokens are fetched from when
+	// impersonating a service account or federating an external identity.
+	IAMCredentialsBasePath string
+	STSBasePath            string
+
+	clients   *serviceClientCache
+	nodePools *nodePoolCache
 
 	requestBatcherServiceUsage *RequestBatcher
 	requestBatcherIam          *RequestBatcher
@@ -75,6 +108,14 @@ func (c *Config) LoadAndValidate(ctx context.Context) error {
 	}
 
 	c.context = ctx
+	c.clients = newServiceClientCache()
+	c.nodePools = newNodePoolCache()
+
+	baseTransport, err := newBaseTransport(c.HTTPProxy, c.CABundle)
+	if err != nil {
+		return err
+	}
+	c.baseTransport = baseTransport
 
 	tokenSource, err := c.getTokenSource(c.Scopes)
 	if err != nil {
@@ -82,7 +123,7 @@ func (c *Config) LoadAndValidate(ctx context.Context) error {
 	}
 	c.tokenSource = tokenSource
 
-	cleanCtx := context.WithValue(ctx, oauth2.HTTPClient, cleanhttp.DefaultClient())
+	cleanCtx := context.WithValue(ctx, oauth2.HTTPClient, c.tokenClient())
 
 	// 1. OAUTH2 TRANSPORT/CLIENT - sets up proper auth headers
 	client := oauth2.NewClient(cleanCtx, tokenSource)
@@ -90,14 +131,29 @@ func (c *Config) LoadAndValidate(ctx context.Context) error {
 	// 2. Logging Transport - ensure we log HTTP requests to GCP APIs.
 	loggingTransport := logging.NewTransport("Google", client.Transport)
 
-	// 3. Retry Transport - retries common temporary errors
+	// 3. Rate Limit Transport - spaces out requests to each API, including
+	// every retried attempt.
+	if c.RateLimits == nil {
+		c.RateLimits = &rateLimitSettings{}
+	}
+	rateLimitTransport := newRateLimitTransport(loggingTransport, c, c.RateLimits)
+
+	// 4. Retry Transport - retries common temporary errors
 	// Keep order for wrapping logging so we log each retried request as well.
 	// This value should be used if needed to create shallow copies with additional retry predicates.
 	// See ClientWithAdditionalRetries
-	retryTransport := NewTransportWithDefaultRetries(loggingTransport)
+	if c.RetrySettings == nil {
+		c.RetrySettings = &retrySettings{}
+	}
+	retryTransport := NewTransportWithRetrySettings(rateLimitTransport, c.RetrySettings)
+
+	// 5. Tracing Transport - records a span per request, which the retry
+	// transport annotates with its attempts.
+	c.tracer = newTracer(ctx, c.Telemetry)
+	tracingTransport := newTracingTransport(retryTransport, c.tracer)
 
 	// Set final transport value.
-	client.Transport = retryTransport
+	client.Transport = tracingTransport
 
 	// This timeout is a timeout per HTTP request, not per logical operation.
 	client.Timeout = c.synchronousTimeout()
@@ -107,10 +163,20 @@ func (c *Config) LoadAndValidate(ctx context.Context) error {
 
 	c.Region = glBeta.GetRegionFromRegionSelfLink(c.Region)
 
+	c.metrics = newMetricsRegistry(c.MetricsTextfilePath)
+
 	c.requestBatcherServiceUsage = NewRequestBatcher("Service Usage", ctx, c.BatchingConfig)
 	c.requestBatcherIam = NewRequestBatcher("IAM", ctx, c.BatchingConfig)
 
-	c.PollInterval = 10 * time.Second
+	if c.PollInterval == 0 {
+		c.PollInterval = defaultOperationPollInterval
+	}
+	if c.PollMaxInterval == 0 {
+		c.PollMaxInterval = defaultOperationPollMaxInterval
+	}
+	if c.PollMaxInterval < c.PollInterval {
+		return fmt.Errorf("operation_poll_max_interval (%s) must not be shorter than operation_poll_interval (%s)", c.PollMaxInterval, c.PollInterval)
+	}
 
 	return nil
 }
@@ -145,6 +211,27 @@ func expandProviderBatchingConfig(v interface{}) (*batchingConfig, error) {
 	return config, nil
 }
 
+func expandProviderRetrySettings(v interface{}) *retrySettings {
+	settings := &retrySettings{}
+
+	ls, _ := v.([]interface{})
+	if len(ls) == 0 || ls[0] == nil {
+		return settings
+	}
+
+	cfgV := ls[0].(map[string]interface{})
+	if codes, ok := cfgV["codes"].([]interface{}); ok {
+		for _, code := range codes {
+			settings.codes = append(settings.codes, code.(int))
+		}
+	}
+	if maxAttempts, ok := cfgV["max_attempts"]; ok {
+		settings.maxAttempts = maxAttempts.(int)
+	}
+
+	return settings
+}
+
 func (c *Config) synchronousTimeout() time.Duration {
 	if c.RequestTimeout == 0 {
 		return 30 * time.Second
@@ -152,7 +239,30 @@ func (c *Config) synchronousTimeout() time.Duration {
 	return c.RequestTimeout
 }
 
+// withRetryCounters returns a copy of c whose requests to Google APIs also
+// count their retries in counters. It shares everything with c but the API
+// service clients, which are bound to the HTTP client.
+func (c *Config) withRetryCounters(counters *retryCounters) *Config {
+	copied := *c
+	client := *c.client
+	client.Transport = &retryCountingTransport{counters: counters, internal: c.client.Transport}
+	copied.client = &client
+	copied.context = contextWithRetryCounters(c.context, counters)
+	copied.clients = newServiceClientCache()
+	return &copied
+}
+
 func (c *Config) getTokenSource(clientScopes []string) (oauth2.TokenSource, error) {
+	if c.ImpersonateServiceAccount != "" {
+		creds, err := c.GetCredentials([]string{cloudPlatformScope})
+		if err != nil {
+			return nil, fmt.Errorf("%s", err)
+		}
+		log.Printf("[INFO] Impersonating service account %s", c.ImpersonateServiceAccount)
+		url := serviceAccountImpersonationURL(c.iamCredentialsBasePath(), c.ImpersonateServiceAccount)
+		return c.impersonatedTokenSource(creds.TokenSource, url, c.ImpersonateServiceAccountDelegates, clientScopes), nil
+	}
+
 	creds, err := c.GetCredentials(clientScopes)
 	if err != nil {
 		return nil, fmt.Errorf("%s", err)
@@ -167,59 +277,71 @@ func (c *Config) getTokenSource(clientScopes []string) (oauth2.TokenSource, erro
 // of those "projects" as well. You can find out if this is required by looking at
 // the basePath value in the client library file.
 func (c *Config) NewComputeClient(userAgent string) *compute.Service {
-	computeClientBasePath := c.ComputeBasePath + "projects/"
-	log.Printf("[INFO] Instantiating GCE client for path %s", computeClientBasePath)
-	clientCompute, err := compute.NewService(c.context, option.WithHTTPClient(c.client))
-	if err != nil {
-		log.Printf("[WARN] Error creating client compute: %s", err)
-		return nil
-	}
-	clientCompute.UserAgent = userAgent
-	clientCompute.BasePath = computeClientBasePath
+	client, _ := c.clients.get("compute", userAgent, func() interface{} {
+		computeClientBasePath := c.ComputeBasePath + "projects/"
+		log.Printf("[INFO] Instantiating GCE client for path %s", computeClientBasePath)
+		clientCompute, err := compute.NewService(c.context, option.WithHTTPClient(c.client))
+		if err != nil {
+			log.Printf("[WARN] Error creating client compute: %s", err)
+			return nil
+		}
+		clientCompute.UserAgent = userAgent
+		clientCompute.BasePath = computeClientBasePath
 
-	return clientCompute
+		return clientCompute
+	}).(*compute.Service)
+	return client
 }
 
 func (c *Config) NewComputeBetaClient(userAgent string) *computeBeta.Service {
-	computeBetaClientBasePath := c.ComputeBetaBasePath + "projects/"
-	log.Printf("[INFO] Instantiating GCE Beta client for path %s", computeBetaClientBasePath)
-	clientComputeBeta, err := computeBeta.NewService(c.context, option.WithHTTPClient(c.client))
-	if err != nil {
-		log.Printf("[WARN] Error creating client compute beta: %s", err)
-		return nil
-	}
-	clientComputeBeta.UserAgent = userAgent
-	clientComputeBeta.BasePath = computeBetaClientBasePath
+	client, _ := c.clients.get("computeBeta", userAgent, func() interface{} {
+		computeBetaClientBasePath := c.ComputeBetaBasePath + "projects/"
+		log.Printf("[INFO] Instantiating GCE Beta client for path %s", computeBetaClientBasePath)
+		clientComputeBeta, err := computeBeta.NewService(c.context, option.WithHTTPClient(c.client))
+		if err != nil {
+			log.Printf("[WARN] Error creating client compute beta: %s", err)
+			return nil
+		}
+		clientComputeBeta.UserAgent = userAgent
+		clientComputeBeta.BasePath = computeBetaClientBasePath
 
-	return clientComputeBeta
+		return clientComputeBeta
+	}).(*computeBeta.Service)
+	return client
 }
 
 func (c *Config) NewContainerClient(userAgent string) *container.Service {
-	containerClientBasePath := removeBasePathVersion(c.ContainerBasePath)
-	log.Printf("[INFO] Instantiating GKE client for path %s", containerClientBasePath)
-	clientContainer, err := container.NewService(c.context, option.WithHTTPClient(c.client))
-	if err != nil {
-		log.Printf("[WARN] Error creating client container: %s", err)
-		return nil
-	}
-	clientContainer.UserAgent = userAgent
-	clientContainer.BasePath = containerClientBasePath
+	client, _ := c.clients.get("container", userAgent, func() interface{} {
+		containerClientBasePath := removeBasePathVersion(c.ContainerBasePath)
+		log.Printf("[INFO] Instantiating GKE client for path %s", containerClientBasePath)
+		clientContainer, err := container.NewService(c.context, option.WithHTTPClient(c.client))
+		if err != nil {
+			log.Printf("[WARN] Error creating client container: %s", err)
+			return nil
+		}
+		clientContainer.UserAgent = userAgent
+		clientContainer.BasePath = containerClientBasePath
 
-	return clientContainer
+		return clientContainer
+	}).(*container.Service)
+	return client
 }
 
 func (c *Config) NewContainerBetaClient(userAgent string) *containerBeta.Service {
-	containerBetaClientBasePath := removeBasePathVersion(c.ContainerBetaBasePath)
-	log.Printf("[INFO] Instantiating GKE Beta client for path %s", containerBetaClientBasePath)
-	clientContainerBeta, err := containerBeta.NewService(c.context, option.WithHTTPClient(c.client))
-	if err != nil {
-		log.Printf("[WARN] Error creating client container beta: %s", err)
-		return nil
-	}
-	clientContainerBeta.UserAgent = userAgent
-	clientContainerBeta.BasePath = containerBetaClientBasePath
+	client, _ := c.clients.get("containerBeta", userAgent, func() interface{} {
+		containerBetaClientBasePath := removeBasePathVersion(c.ContainerBetaBasePath)
+		log.Printf("[INFO] Instantiating GKE Beta client for path %s", containerBetaClientBasePath)
+		clientContainerBeta, err := containerBeta.NewService(c.context, option.WithHTTPClient(c.client))
+		if err != nil {
+			log.Printf("[WARN] Error creating client container beta: %s", err)
+			return nil
+		}
+		clientContainerBeta.UserAgent = userAgent
+		clientContainerBeta.BasePath = containerBetaClientBasePath
 
-	return clientContainerBeta
+		return clientContainerBeta
+	}).(*containerBeta.Service)
+	return client
 }
 
 // staticTokenSource is used to be able to identify static token sources without reflection.
@@ -228,6 +350,29 @@ type staticTokenSource struct {
 }
 
 func (c *Config) GetCredentials(clientScopes []string) (googleoauth.Credentials, error) {
+	if c.AccessTokenCommand != "" || c.AccessTokenFile != "" {
+		if c.AccessTokenCommand != "" {
+			log.Printf("[INFO] Authenticating using access tokens printed by 'access_token_command'...")
+		} else {
+			log.Printf("[INFO] Authenticating using access tokens read from 'access_token_file' %s...", c.AccessTokenFile)
+		}
+		log.Printf("[INFO]   -- Scopes: %s", clientScopes)
+		ts := &externalAccessTokenSource{
+			ctx:     c.tokenContext(),
+			command: c.AccessTokenCommand,
+			path:    c.AccessTokenFile,
+		}
+		// Read the first token now, so that a broken command or file fails
+		// the configuration rather than the first request.
+		token, err := ts.Token()
+		if err != nil {
+			return googleoauth.Credentials{}, err
+		}
+		return googleoauth.Credentials{
+			TokenSource: oauth2.ReuseTokenSource(token, ts),
+		}, nil
+	}
+
 	if c.AccessToken != "" {
 		contents, _, err := pathOrContents(c.AccessToken)
 		if err != nil {
@@ -244,25 +389,50 @@ func (c *Config) GetCredentials(clientScopes []string) (googleoauth.Credentials,
 	}
 
 	if c.Credentials != "" {
-		contents, _, err := pathOrContents(c.Credentials)
+		contents, fromPath, err := pathOrContents(c.Credentials)
 		if err != nil {
 			return googleoauth.Credentials{}, fmt.Errorf("error loading credentials: %s", err)
 		}
+		// The contents are secret, so errors only name where they came from.
+		source := "the `credentials` field"
+		if fromPath {
+			source = c.Credentials
+		}
 
-		creds, err := googleoauth.CredentialsFromJSON(c.context, []byte(contents), clientScopes...)
+		f, err := parseCredentialsFile([]byte(contents))
+		if err != nil {
+			return googleoauth.Credentials{}, fmt.Errorf("unable to parse credentials from %s: %s", source, err)
+		}
+		creds, err := c.credentialsFromFile(f, []byte(contents), clientScopes)
 		if err != nil {
-			return googleoauth.Credentials{}, fmt.Errorf("unable to parse credentials from '%s': %s", contents, err)
+			return googleoauth.Credentials{}, fmt.Errorf("unable to parse credentials of type %q from %s: %s", f.Type, source, err)
 		}
 
-		log.Printf("[INFO] Authenticating using configured Google JSON 'credentials'...")
+		log.Printf("[INFO] Authenticating using configured Google JSON 'credentials' of type %q...", f.Type)
 		log.Printf("[INFO]   -- Scopes: %s", clientScopes)
 		return *creds, nil
 	}
 
+	// The application default credentials may be of a type the vendored
+	// golang.org/x/oauth2 does not know.
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		if contents, err := ioutil.ReadFile(path); err == nil {
+			if f, err := parseCredentialsFile(contents); err == nil && (f.Type == externalAccountCredentialsType || f.Type == impersonatedServiceAccountCredentialsType) {
+				log.Printf("[INFO] Authenticating using application default credentials of type %q...", f.Type)
+				log.Printf("[INFO]   -- Scopes: %s", clientScopes)
+				creds, err := c.credentialsFromFile(f, contents, clientScopes)
+				if err != nil {
+					return googleoauth.Credentials{}, fmt.Errorf("unable to parse credentials from %s: %s", path, err)
+				}
+				return *creds, nil
+			}
+		}
+	}
+
 	log.Printf("[INFO] Authenticating using DefaultClient...")
 	log.Printf("[INFO]   -- Scopes: %s", clientScopes)
 
-	defaultTS, err := googleoauth.DefaultTokenSource(context.Background(), clientScopes...)
+	defaultTS, err := googleoauth.DefaultTokenSource(c.tokenContext(), clientScopes...)
 	if err != nil {
 		return googleoauth.Credentials{}, fmt.Errorf("Attempted to load application default credentials since neither `credentials` nor `access_token` was set in the provider block.  No credentials loaded. To use your gcloud credentials, run 'gcloud auth application-default login'.  Original error: %w", err)
 	}
@@ -287,4 +457,6 @@ func ConfigureBasePaths(c *Config) {
 	// Handwritten Products / Versioned / Atypical Entries
 	c.ContainerBasePath = ContainerDefaultBasePath
 	c.ContainerBetaBasePath = ContainerBetaDefaultBasePath
+	c.IAMCredentialsBasePath = IAMCredentialsDefaultBasePath
+	c.STSBasePath = STSDefaultBasePath
 }
@@ -7,7 +7,7 @@ import (
 	"log"
 	"time"
 
-	glBeta "github.com/hashicorp/terraform-provider-google-beta/google-beta"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
 	container "google.golang.org/api/container/v1beta1"
 )
 
@@ -110,6 +110,37 @@ func containerOperationWait(config *Config, op *container.Operation, project, lo
 	if err := w.SetOp(op); err != nil {
 		return err
 	}
+	if w.State() == "DONE" {
+		return w.Error()
+	}
+
+	err := pollWithBackoff(config, timeout, func() (float64, *resource.RetryError) {
+		op, err := w.QueryOp()
+		if err != nil {
+			// Retry 404 when getting operation (not resource state)
+			if isGoogleApiErrorWithCode(err, 404) {
+				log.Printf("[DEBUG] Dismissed retryable error on GET operation %q: %s", w.OpName(), err)
+				return -1, resource.RetryableError(err)
+			}
+			return -1, resource.NonRetryableError(fmt.Errorf("error while retrieving operation: %s", err))
+		}
+		if err := w.SetOp(op); err != nil {
+			return -1, resource.NonRetryableError(fmt.Errorf("Cannot continue, unable to use operation: %s", err))
+		}
+		if err := w.Error(); err != nil {
+			return -1, resource.NonRetryableError(err)
+		}
+
+		progress := containerOperationProgress(w.Op)
+		log.Printf("[DEBUG] Got %v while polling for operation %s's status, progress %.2f", w.State(), w.OpName(), progress)
+		if w.State() == "DONE" {
+			return progress, nil
+		}
+		return progress, resource.RetryableError(fmt.Errorf("operation %s is %s", w.OpName(), w.State()))
+	})
+	if err != nil {
+		return fmt.Errorf("Error waiting for %s: %s", activity, err)
+	}
 
-	return glBeta.OperationWait(w, activity, timeout, config.PollInterval)
+	return w.Error()
 }
@@ -0,0 +1,230 @@
+package rollgcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsSecurityCredentials are the AWS credentials a subject token is signed
+// with.
+type awsSecurityCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// awsSubjectToken returns the subject token of AWS workload identity
+// federation: a GetCallerIdentity request signed with the AWS credentials of
+// the environment, which STS sends on to AWS to find out who is calling.
+func (ts *externalAccountTokenSource) awsSubjectToken() (string, error) {
+	source := ts.file.CredentialSource
+
+	var sessionToken string
+	if source.IMDSv2SessionTokenURL != "" && (awsRegionFromEnv() == "" || os.Getenv("AWS_ACCESS_KEY_ID") == "") {
+		var err error
+		if sessionToken, err = ts.awsMetadataSessionToken(); err != nil {
+			return "", err
+		}
+	}
+
+	region := awsRegionFromEnv()
+	if region == "" {
+		if source.RegionURL == "" {
+			return "", fmt.Errorf("no AWS region is set and credential_source has no region_url")
+		}
+		zone, err := ts.awsMetadata(source.RegionURL, sessionToken)
+		if err != nil {
+			return "", fmt.Errorf("Error reading the AWS region: %s", err)
+		}
+		// The metadata server returns the zone, such as us-east-1b.
+		if len(zone) < 2 {
+			return "", fmt.Errorf("Error reading the AWS region: invalid zone %q", zone)
+		}
+		region = zone[:len(zone)-1]
+	}
+
+	creds := awsSecurityCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Token:           os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		if source.URL == "" {
+			return "", fmt.Errorf("no AWS credentials are set and credential_source has no url")
+		}
+		role, err := ts.awsMetadata(source.URL, sessionToken)
+		if err != nil {
+			return "", fmt.Errorf("Error reading the AWS role: %s", err)
+		}
+		raw, err := ts.awsMetadata(strings.TrimSuffix(source.URL, "/")+"/"+role, sessionToken)
+		if err != nil {
+			return "", fmt.Errorf("Error reading the AWS credentials of role %s: %s", role, err)
+		}
+		if err := json.Unmarshal([]byte(raw), &creds); err != nil {
+			return "", fmt.Errorf("Error reading the AWS credentials of role %s: %s", role, err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", strings.Replace(source.RegionalCredVerificationURL, "{region}", region, -1), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-goog-cloud-target-resource", ts.file.Audience)
+	if creds.Token != "" {
+		req.Header.Set("x-amz-security-token", creds.Token)
+	}
+	signAWSRequest(req, nil, region, "sts", &creds, time.Now())
+
+	// The token is the signed request, serialized as STS expects it.
+	type header struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	token := struct {
+		URL     string   `json:"url"`
+		Method  string   `json:"method"`
+		Headers []header `json:"headers"`
+	}{
+		URL:    req.URL.String(),
+		Method: req.Method,
+	}
+	keys := make([]string, 0, len(req.Header)+1)
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	token.Headers = append(token.Headers, header{Key: "host", Value: req.URL.Host})
+	for _, k := range keys {
+		token.Headers = append(token.Headers, header{Key: k, Value: req.Header.Get(k)})
+	}
+	raw, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return url.QueryEscape(string(raw)), nil
+}
+
+func awsRegionFromEnv() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// awsMetadataSessionToken fetches the session token that version 2 of the
+// EC2 instance metadata service requires.
+func (ts *externalAccountTokenSource) awsMetadataSessionToken() (string, error) {
+	req, err := http.NewRequest("PUT", ts.file.CredentialSource.IMDSv2SessionTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ts.config.tokenContext())
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	return ts.readAWSMetadata(req)
+}
+
+func (ts *externalAccountTokenSource) awsMetadata(u, sessionToken string) (string, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ts.config.tokenContext())
+	if sessionToken != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", sessionToken)
+	}
+	return ts.readAWSMetadata(req)
+}
+
+func (ts *externalAccountTokenSource) readAWSMetadata(req *http.Request) (string, error) {
+	resp, err := ts.config.tokenClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s: %s", req.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// signAWSRequest adds the date and authorization headers of AWS Signature
+// Version 4 to req, which has the given body.
+func signAWSRequest(req *http.Request, body []byte, region, service string, creds *awsSecurityCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+
+	// Header names are signed in lower case, sorted, with the host among
+	// them.
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalQuery encodes the query as Signature Version 4 expects:
+// sorted, with spaces as %20.
+func awsCanonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
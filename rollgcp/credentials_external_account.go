@@ -0,0 +1,417 @@
+package rollgcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"golang.org/x/oauth2"
+	googleoauth "golang.org/x/oauth2/google"
+)
+
+// The credential types handled here rather than by golang.org/x/oauth2,
+// whose vendored version predates them.
+const (
+	externalAccountCredentialsType            = "external_account"
+	impersonatedServiceAccountCredentialsType = "impersonated_service_account"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// credentialsFile holds the fields of a credentials JSON file that are read
+// here. Only its type is read for the types golang.org/x/oauth2 handles.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// external_account
+	Audience                       string                    `json:"audience"`
+	SubjectTokenType               string                    `json:"subject_token_type"`
+	TokenURL                       string                    `json:"token_url"`
+	ServiceAccountImpersonationURL string                    `json:"service_account_impersonation_url"`
+	ClientID                       string                    `json:"client_id"`
+	ClientSecret                   string                    `json:"client_secret"`
+	QuotaProjectID                 string                    `json:"quota_project_id"`
+	CredentialSource               *externalCredentialSource `json:"credential_source"`
+
+	// impersonated_service_account
+	Delegates         []string        `json:"delegates"`
+	SourceCredentials json.RawMessage `json:"source_credentials"`
+}
+
+// externalCredentialSource tells where an external account reads the token
+// it exchanges with STS from: a file, a URL, or AWS.
+type externalCredentialSource struct {
+	File    string            `json:"file"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Format  struct {
+		// Type is text or json.
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+
+	EnvironmentID               string `json:"environment_id"`
+	RegionURL                   string `json:"region_url"`
+	RegionalCredVerificationURL string `json:"regional_cred_verification_url"`
+	IMDSv2SessionTokenURL       string `json:"imdsv2_session_token_url"`
+}
+
+func parseCredentialsFile(contents []byte) (*credentialsFile, error) {
+	var f credentialsFile
+	if err := json.Unmarshal(contents, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// validate checks the credentials of the types handled here for the fields
+// they need. Other types are left to golang.org/x/oauth2.
+func (f *credentialsFile) validate() error {
+	switch f.Type {
+	case externalAccountCredentialsType:
+		if f.Audience == "" {
+			return fmt.Errorf("external_account credentials need an audience")
+		}
+		if f.SubjectTokenType == "" {
+			return fmt.Errorf("external_account credentials need a subject_token_type")
+		}
+		if err := validateTokenEndpoint("token_url", f.TokenURL); err != nil {
+			return err
+		}
+		if f.ServiceAccountImpersonationURL != "" {
+			if err := validateImpersonationURL(f.ServiceAccountImpersonationURL); err != nil {
+				return err
+			}
+		}
+		return f.CredentialSource.validate()
+
+	case impersonatedServiceAccountCredentialsType:
+		if err := validateImpersonationURL(f.ServiceAccountImpersonationURL); err != nil {
+			return err
+		}
+		if len(f.SourceCredentials) == 0 {
+			return fmt.Errorf("impersonated_service_account credentials need source_credentials")
+		}
+		source, err := parseCredentialsFile(f.SourceCredentials)
+		if err != nil {
+			return fmt.Errorf("source_credentials: %s", err)
+		}
+		switch source.Type {
+		case "service_account", "authorized_user":
+			if _, err := googleoauth.CredentialsFromJSON(context.Background(), f.SourceCredentials); err != nil {
+				return fmt.Errorf("source_credentials: %s", err)
+			}
+		case externalAccountCredentialsType:
+			if err := source.validate(); err != nil {
+				return fmt.Errorf("source_credentials: %s", err)
+			}
+		default:
+			return fmt.Errorf("source_credentials of type %q cannot be impersonated from", source.Type)
+		}
+	}
+	return nil
+}
+
+func (s *externalCredentialSource) validate() error {
+	if s == nil {
+		return fmt.Errorf("external_account credentials need a credential_source")
+	}
+	sources := 0
+	for _, v := range []string{s.File, s.URL, s.EnvironmentID} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("credential_source needs exactly one of file, url and environment_id")
+	}
+
+	if s.EnvironmentID != "" {
+		if !strings.HasPrefix(s.EnvironmentID, "aws") {
+			return fmt.Errorf("credential_source has unsupported environment_id %q", s.EnvironmentID)
+		}
+		if s.EnvironmentID != "aws1" {
+			return fmt.Errorf("credential_source has unsupported AWS version %q", s.EnvironmentID)
+		}
+		if s.RegionalCredVerificationURL == "" {
+			return fmt.Errorf("credential_source of AWS needs a regional_cred_verification_url")
+		}
+		return nil
+	}
+
+	if s.URL != "" {
+		if u, err := url.Parse(s.URL); err != nil || u.Host == "" {
+			return fmt.Errorf("credential_source has an invalid url %q", s.URL)
+		}
+	}
+	switch s.Format.Type {
+	case "", "text":
+	case "json":
+		if s.Format.SubjectTokenFieldName == "" {
+			return fmt.Errorf("credential_source of format json needs a subject_token_field_name")
+		}
+	default:
+		return fmt.Errorf("credential_source has unsupported format %q", s.Format.Type)
+	}
+	return nil
+}
+
+// validateTokenEndpoint checks that a token endpoint is safe to send
+// credentials to: over HTTPS, or over HTTP to this machine only.
+func validateTokenEndpoint(field, v string) error {
+	if v == "" {
+		return fmt.Errorf("credentials need a %s", field)
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("credentials have an invalid %s %q", field, v)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if host := u.Hostname(); host == "localhost" || net.ParseIP(host).IsLoopback() {
+			return nil
+		}
+	}
+	return fmt.Errorf("credentials have a %s of %q, which is not HTTPS", field, v)
+}
+
+func validateImpersonationURL(v string) error {
+	if err := validateTokenEndpoint("service_account_impersonation_url", v); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(v, ":generateAccessToken") {
+		return fmt.Errorf("service_account_impersonation_url %q does not end in :generateAccessToken", v)
+	}
+	return nil
+}
+
+// credentialsFromFile returns credentials for the parsed credentials JSON
+// contents. The types golang.org/x/oauth2 knows are passed on to it.
+func (c *Config) credentialsFromFile(f *credentialsFile, contents []byte, clientScopes []string) (*googleoauth.Credentials, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	var ts oauth2.TokenSource
+	switch f.Type {
+	case externalAccountCredentialsType:
+		ts = c.externalAccountTokenSource(f, clientScopes)
+
+	case impersonatedServiceAccountCredentialsType:
+		source, err := parseCredentialsFile(f.SourceCredentials)
+		if err != nil {
+			return nil, err
+		}
+		sourceCreds, err := c.credentialsFromFile(source, f.SourceCredentials, []string{cloudPlatformScope})
+		if err != nil {
+			return nil, fmt.Errorf("source_credentials: %s", err)
+		}
+		ts = c.impersonatedTokenSource(sourceCreds.TokenSource, f.ServiceAccountImpersonationURL, f.Delegates, clientScopes)
+
+	default:
+		return googleoauth.CredentialsFromJSON(c.tokenContext(), contents, clientScopes...)
+	}
+
+	return &googleoauth.Credentials{
+		ProjectID:   f.QuotaProjectID,
+		TokenSource: oauth2.ReuseTokenSource(nil, ts),
+		JSON:        contents,
+	}, nil
+}
+
+// tokenClient returns the HTTP client used to fetch tokens, which cannot go
+// through the authenticated client.
+func (c *Config) tokenClient() *http.Client {
+	if c.baseTransport == nil {
+		return cleanhttp.DefaultClient()
+	}
+	return &http.Client{Transport: c.baseTransport}
+}
+
+// tokenContext returns the context tokens are fetched in, which makes
+// golang.org/x/oauth2 fetch them with tokenClient.
+func (c *Config) tokenContext() context.Context {
+	ctx := c.context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, c.tokenClient())
+}
+
+func (c *Config) stsBasePath() string {
+	if c.STSBasePath != "" {
+		return c.STSBasePath
+	}
+	return STSDefaultBasePath
+}
+
+// rebaseURL moves a URL under the default base path of an API to its
+// configured base path, for credentials files that name Google's endpoints.
+func rebaseURL(u, defaultBasePath, basePath string) string {
+	if basePath == defaultBasePath || !strings.HasPrefix(u, defaultBasePath) {
+		return u
+	}
+	rebased := basePath + strings.TrimPrefix(u, defaultBasePath)
+	log.Printf("[DEBUG] Using %s in place of %s", rebased, u)
+	return rebased
+}
+
+// externalAccountTokenSource exchanges the token of an external identity
+// provider for a Google access token with the Security Token Service, and
+// impersonates a service account with it if the credentials say so.
+type externalAccountTokenSource struct {
+	config *Config
+	file   *credentialsFile
+	scopes []string
+}
+
+func (c *Config) externalAccountTokenSource(f *credentialsFile, clientScopes []string) oauth2.TokenSource {
+	ts := &externalAccountTokenSource{
+		config: c,
+		file:   f,
+		scopes: clientScopes,
+	}
+	if f.ServiceAccountImpersonationURL == "" {
+		return ts
+	}
+	// The token from STS is only used to impersonate the service account,
+	// which is given the scopes instead.
+	ts.scopes = []string{cloudPlatformScope}
+	return c.impersonatedTokenSource(oauth2.ReuseTokenSource(nil, ts), f.ServiceAccountImpersonationURL, nil, clientScopes)
+}
+
+// Token implements the oauth2.TokenSource interface method.
+func (ts *externalAccountTokenSource) Token() (*oauth2.Token, error) {
+	subjectToken, err := ts.subjectToken()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the subject token of external_account credentials: %s", err)
+	}
+
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {ts.file.Audience},
+		"scope":                {strings.Join(ts.scopes, " ")},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {ts.file.SubjectTokenType},
+	}
+	tokenURL := rebaseURL(ts.file.TokenURL, STSDefaultBasePath, ts.config.stsBasePath())
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ts.config.tokenContext())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if ts.file.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(ts.file.ClientID), url.QueryEscape(ts.file.ClientSecret))
+	}
+
+	var resp struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := doTokenRequest(ts.config.tokenClient(), req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Error exchanging the subject token with %s: %s", tokenURL, err)
+	}
+	if status != http.StatusOK || resp.AccessToken == "" {
+		return nil, fmt.Errorf("Error exchanging the subject token with %s: %d %s: %s", tokenURL, status, resp.Error, resp.ErrorDescription)
+	}
+
+	log.Printf("[DEBUG] Exchanged the subject token of external_account credentials for an access token expiring in %ds", resp.ExpiresIn)
+	token := &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   resp.TokenType,
+	}
+	if resp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// subjectToken reads the token of the external identity provider. It is
+// read afresh for every exchange, since the provider rotates it.
+func (ts *externalAccountTokenSource) subjectToken() (string, error) {
+	source := ts.file.CredentialSource
+	if source.EnvironmentID != "" {
+		return ts.awsSubjectToken()
+	}
+
+	var raw []byte
+	if source.File != "" {
+		var err error
+		if raw, err = ioutil.ReadFile(source.File); err != nil {
+			return "", err
+		}
+	} else {
+		req, err := http.NewRequest("GET", source.URL, nil)
+		if err != nil {
+			return "", err
+		}
+		req = req.WithContext(ts.config.tokenContext())
+		for k, v := range source.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := ts.config.tokenClient().Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if raw, err = ioutil.ReadAll(resp.Body); err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s returned %s: %s", source.URL, resp.Status, strings.TrimSpace(string(raw)))
+		}
+	}
+
+	if source.Format.Type == "json" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return "", fmt.Errorf("the subject token is not JSON: %s", err)
+		}
+		token, ok := fields[source.Format.SubjectTokenFieldName].(string)
+		if !ok || token == "" {
+			return "", fmt.Errorf("the subject token has no field %q", source.Format.SubjectTokenFieldName)
+		}
+		return token, nil
+	}
+
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", fmt.Errorf("the subject token is empty")
+	}
+	return token, nil
+}
+
+// doTokenRequest sends a request to a token endpoint and decodes its JSON
+// response into out, whatever its status.
+func doTokenRequest(client *http.Client, req *http.Request, out interface{}) (int, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp.StatusCode, nil
+}
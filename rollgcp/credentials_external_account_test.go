@@ -0,0 +1,241 @@
+package rollgcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+const (
+	testAudience        = "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+	testSubjectToken    = "subject-token"
+	testFederatedToken  = "federated-token"
+	testClientSecret    = "client-secret-that-must-not-leak"
+	testServiceAccount  = "sa@my-project.iam.gserviceaccount.com"
+	testDelegateAccount = "delegate@my-project.iam.gserviceaccount.com"
+)
+
+// fakeGoogleTokenAPIs serves the token exchange of STS and the
+// generateAccessToken method of IAM Credentials under /v1/.
+type fakeGoogleTokenAPIs struct {
+	*httptest.Server
+	t *testing.T
+
+	lock        sync.Mutex
+	exchanges   int
+	impersonate map[string][]string
+}
+
+func newFakeGoogleTokenAPIs(t *testing.T) *fakeGoogleTokenAPIs {
+	f := &fakeGoogleTokenAPIs{t: t, impersonate: map[string][]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/token", f.token)
+	mux.HandleFunc("/v1/projects/-/serviceAccounts/", f.generateAccessToken)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeGoogleTokenAPIs) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		f.t.Errorf("STS received an invalid form: %s", err)
+	}
+	want := map[string]string{
+		"grant_type":         "urn:ietf:params:oauth:grant-type:token-exchange",
+		"audience":           testAudience,
+		"subject_token":      testSubjectToken,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"scope":              cloudPlatformScope,
+	}
+	for k, v := range want {
+		if got := r.PostForm.Get(k); got != v {
+			f.t.Errorf("STS received %s %q, expected %q", k, got, v)
+		}
+	}
+
+	f.lock.Lock()
+	f.exchanges++
+	f.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": 3600, "issued_token_type": "urn:ietf:params:oauth:token-type:access_token"}`, testFederatedToken)
+}
+
+func (f *fakeGoogleTokenAPIs) generateAccessToken(w http.ResponseWriter, r *http.Request) {
+	if got := r.Header.Get("Authorization"); got != "Bearer "+testFederatedToken {
+		f.t.Errorf("IAM Credentials received Authorization %q, expected the federated token", got)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, ":generateAccessToken") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	serviceAccount := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/-/serviceAccounts/"), ":generateAccessToken")
+
+	var body struct {
+		Delegates []string `json:"delegates"`
+		Scope     []string `json:"scope"`
+		Lifetime  string   `json:"lifetime"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.t.Errorf("IAM Credentials received an invalid body: %s", err)
+	}
+	if body.Lifetime != "3600s" {
+		f.t.Errorf("IAM Credentials received lifetime %q, expected 3600s", body.Lifetime)
+	}
+
+	f.lock.Lock()
+	f.impersonate[serviceAccount] = body.Delegates
+	f.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"accessToken": %q, "expireTime": %q}`, "impersonated-"+serviceAccount, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+}
+
+// externalAccountCredentials returns external_account credentials with a
+// subject token file, naming Google's own endpoints as a real file does.
+func externalAccountCredentials(t *testing.T, impersonate bool) string {
+	dir, err := ioutil.TempDir("", "rollgcp-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(testSubjectToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := map[string]interface{}{
+		"type":               externalAccountCredentialsType,
+		"audience":           testAudience,
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":          STSDefaultBasePath + "token",
+		"credential_source": map[string]interface{}{
+			"file": tokenFile,
+		},
+	}
+	if impersonate {
+		creds["service_account_impersonation_url"] = serviceAccountImpersonationURL(IAMCredentialsDefaultBasePath, testServiceAccount)
+	}
+	raw, err := json.Marshal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+// configureTestProvider configures the provider as Terraform would with raw.
+func configureTestProvider(t *testing.T, raw map[string]interface{}) *Config {
+	p := Provider()
+	d := schema.TestResourceDataRaw(t, p.Schema, raw)
+	meta, diags := providerConfigure(context.Background(), d, p)
+	if diags.HasError() {
+		t.Fatalf("configuring the provider failed: %v", diags)
+	}
+	return meta.(*Config)
+}
+
+func TestExternalAccountCredentialsCustomEndpoints(t *testing.T) {
+	apis := newFakeGoogleTokenAPIs(t)
+	defer apis.Close()
+
+	config := configureTestProvider(t, map[string]interface{}{
+		"credentials":                        externalAccountCredentials(t, true),
+		STSCustomEndpointEntryKey:            apis.URL + "/v1/",
+		IAMCredentialsCustomEndpointEntryKey: apis.URL + "/v1/",
+	})
+
+	token, err := config.tokenSource.Token()
+	if err != nil {
+		t.Fatalf("fetching a token failed: %s", err)
+	}
+	if token.AccessToken != "impersonated-"+testServiceAccount {
+		t.Errorf("expected the token of the impersonated service account, got %q", token.AccessToken)
+	}
+	if apis.exchanges != 1 {
+		t.Errorf("expected 1 token exchange with STS, got %d", apis.exchanges)
+	}
+	if _, ok := apis.impersonate[testServiceAccount]; !ok {
+		t.Errorf("expected %s to be impersonated, got %v", testServiceAccount, apis.impersonate)
+	}
+
+	// The token is reused until it expires.
+	if _, err := config.tokenSource.Token(); err != nil {
+		t.Fatalf("fetching a token again failed: %s", err)
+	}
+	if apis.exchanges != 1 {
+		t.Errorf("expected the token to be reused, got %d token exchanges", apis.exchanges)
+	}
+}
+
+func TestImpersonateServiceAccountCustomEndpoint(t *testing.T) {
+	apis := newFakeGoogleTokenAPIs(t)
+	defer apis.Close()
+
+	config := configureTestProvider(t, map[string]interface{}{
+		"credentials":                           externalAccountCredentials(t, false),
+		"impersonate_service_account":           testServiceAccount,
+		"impersonate_service_account_delegates": []interface{}{testDelegateAccount},
+		STSCustomEndpointEntryKey:               apis.URL + "/v1/",
+		IAMCredentialsCustomEndpointEntryKey:    apis.URL + "/v1/",
+	})
+
+	token, err := config.tokenSource.Token()
+	if err != nil {
+		t.Fatalf("fetching a token failed: %s", err)
+	}
+	if token.AccessToken != "impersonated-"+testServiceAccount {
+		t.Errorf("expected the token of the impersonated service account, got %q", token.AccessToken)
+	}
+	delegates := apis.impersonate[testServiceAccount]
+	if len(delegates) != 1 || delegates[0] != "projects/-/serviceAccounts/"+testDelegateAccount {
+		t.Errorf("expected delegate %s, got %v", testDelegateAccount, delegates)
+	}
+}
+
+func TestCredentialsErrorsOmitContents(t *testing.T) {
+	var creds map[string]interface{}
+	if err := json.Unmarshal([]byte(externalAccountCredentials(t, false)), &creds); err != nil {
+		t.Fatal(err)
+	}
+	creds["client_id"] = "client"
+	creds["client_secret"] = testClientSecret
+	// Tokens must not be sent in the clear to another machine.
+	creds["token_url"] = "http://sts.example.com/v1/token"
+	raw, err := json.Marshal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"unsafe token_url": string(raw),
+		"invalid JSON":     `{"type": "service_account", "private_key": "` + testClientSecret + `"`,
+	}
+	for name, contents := range cases {
+		_, errs := validateCredentials(contents, "credentials")
+		if len(errs) == 0 {
+			t.Errorf("%s: expected validateCredentials to fail", name)
+		}
+		for _, err := range errs {
+			if strings.Contains(err.Error(), testClientSecret) {
+				t.Errorf("%s: validateCredentials error contains the credentials: %s", name, err)
+			}
+		}
+
+		config := &Config{Credentials: contents}
+		if _, err := config.GetCredentials([]string{cloudPlatformScope}); err == nil {
+			t.Errorf("%s: expected GetCredentials to fail", name)
+		} else if strings.Contains(err.Error(), testClientSecret) {
+			t.Errorf("%s: GetCredentials error contains the credentials: %s", name, err)
+		}
+	}
+}
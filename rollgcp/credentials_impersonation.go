@@ -0,0 +1,113 @@
+package rollgcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// How long the access tokens of impersonated service accounts are asked to
+// last.
+const impersonatedTokenLifetime = time.Hour
+
+// impersonatedTokenSource generates access tokens for a service account with
+// the IAM Credentials API, authenticated by the tokens of source.
+type impersonatedTokenSource struct {
+	config    *Config
+	source    oauth2.TokenSource
+	url       string
+	delegates []string
+	scopes    []string
+}
+
+// impersonatedTokenSource returns a token source that impersonates the
+// service account of the generateAccessToken URL.
+func (c *Config) impersonatedTokenSource(source oauth2.TokenSource, url string, delegates, clientScopes []string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		config:    c,
+		source:    source,
+		url:       rebaseURL(url, IAMCredentialsDefaultBasePath, c.iamCredentialsBasePath()),
+		delegates: delegates,
+		scopes:    clientScopes,
+	})
+}
+
+func (c *Config) iamCredentialsBasePath() string {
+	if c.IAMCredentialsBasePath != "" {
+		return c.IAMCredentialsBasePath
+	}
+	return IAMCredentialsDefaultBasePath
+}
+
+// serviceAccountImpersonationURL returns the generateAccessToken URL of the
+// service account, given by email or as projects/-/serviceAccounts/email.
+func serviceAccountImpersonationURL(basePath, serviceAccount string) string {
+	if !strings.HasPrefix(serviceAccount, "projects/") {
+		serviceAccount = "projects/-/serviceAccounts/" + serviceAccount
+	}
+	return basePath + serviceAccount + ":generateAccessToken"
+}
+
+// Token implements the oauth2.TokenSource interface method.
+func (ts *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	sourceToken, err := ts.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	delegates := make([]string, 0, len(ts.delegates))
+	for _, delegate := range ts.delegates {
+		if !strings.HasPrefix(delegate, "projects/") {
+			delegate = "projects/-/serviceAccounts/" + delegate
+		}
+		delegates = append(delegates, delegate)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"delegates": delegates,
+		"scope":     ts.scopes,
+		"lifetime":  fmt.Sprintf("%ds", int(impersonatedTokenLifetime.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", ts.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ts.config.tokenContext())
+	req.Header.Set("Content-Type", "application/json")
+	sourceToken.SetAuthHeader(req)
+
+	var resp struct {
+		AccessToken string `json:"accessToken"`
+		ExpireTime  string `json:"expireTime"`
+		Error       struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	status, err := doTokenRequest(ts.config.tokenClient(), req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Error impersonating service account with %s: %s", ts.url, err)
+	}
+	if status != http.StatusOK || resp.AccessToken == "" {
+		return nil, fmt.Errorf("Error impersonating service account with %s: %d %s", ts.url, status, resp.Error.Message)
+	}
+
+	expiry, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		return nil, fmt.Errorf("Error impersonating service account with %s: invalid expireTime %q", ts.url, resp.ExpireTime)
+	}
+	log.Printf("[DEBUG] Generated an access token of an impersonated service account, expiring at %s", resp.ExpireTime)
+	return &oauth2.Token{
+		AccessToken: resp.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}, nil
+}
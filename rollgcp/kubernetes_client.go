@@ -0,0 +1,721 @@
+package rollgcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/logging"
+	"golang.org/x/oauth2"
+)
+
+// KubernetesClient is a minimal client for the Kubernetes API server of a GKE
+// cluster. It authenticates with the same token source as the Google API
+// clients, which GKE accepts as a bearer token.
+type KubernetesClient struct {
+	client    *http.Client
+	context   context.Context
+	endpoint  string
+	userAgent string
+}
+
+// KubernetesApiError is returned for any non-2xx response from the API server.
+type KubernetesApiError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *KubernetesApiError) Error() string {
+	return fmt.Sprintf("kubernetes API error %d (%s): %s", e.Code, e.Reason, e.Message)
+}
+
+func isKubernetesApiErrorWithCode(err error, errCode int) bool {
+	kerr, ok := err.(*KubernetesApiError)
+	return ok && kerr.Code == errCode
+}
+
+// NewKubernetesClient looks up the endpoint and CA certificate of the cluster
+// that owns the node pool and returns a client for its API server.
+func (c *Config) NewKubernetesClient(nodePoolInfo *NodePoolInformation, userAgent string) (*KubernetesClient, error) {
+	clustersGetCall := c.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.Get(nodePoolInfo.parent())
+	if c.UserProjectOverride {
+		clustersGetCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
+	}
+	cluster, err := clustersGetCall.Do()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading cluster %q: %s", nodePoolInfo.cluster, err)
+	}
+	if cluster.Endpoint == "" {
+		return nil, fmt.Errorf("Cluster %q has no endpoint", nodePoolInfo.cluster)
+	}
+
+	transport := cleanhttp.DefaultPooledTransport()
+	if c.baseTransport != nil {
+		// The cluster has a CA of its own, but goes through the same proxy.
+		transport.Proxy = c.baseTransport.Proxy
+	}
+	if cluster.MasterAuth != nil && cluster.MasterAuth.ClusterCaCertificate != "" {
+		ca, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding CA certificate of cluster %q: %s", nodePoolInfo.cluster, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Cluster %q has an invalid CA certificate", nodePoolInfo.cluster)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	log.Printf("[INFO] Instantiating Kubernetes client for cluster %s at %s", nodePoolInfo.cluster, cluster.Endpoint)
+
+	return &KubernetesClient{
+		client: &http.Client{
+			Transport: newTracingTransport(logging.NewTransport("Kubernetes", &oauth2.Transport{
+				Source: c.tokenSource,
+				Base:   transport,
+			}), c.tracer),
+			Timeout: c.synchronousTimeout(),
+		},
+		context:   c.context,
+		endpoint:  "https://" + cluster.Endpoint,
+		userAgent: userAgent,
+	}, nil
+}
+
+func (k *KubernetesClient) do(method, path string, query url.Values, contentType string, body, out interface{}) error {
+	u := k.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	if k.context != nil {
+		req = req.WithContext(k.context)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", k.userAgent)
+	if body != nil {
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(respBody, &status); err != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(respBody))
+		}
+		return &KubernetesApiError{
+			Code:    resp.StatusCode,
+			Reason:  status.Reason,
+			Message: status.Message,
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// ListNodes returns the nodes matching the label selector.
+func (k *KubernetesClient) ListNodes(labelSelector string) ([]KubernetesNode, error) {
+	var list struct {
+		Items []KubernetesNode `json:"items"`
+	}
+	query := url.Values{}
+	if labelSelector != "" {
+		query.Set("labelSelector", labelSelector)
+	}
+	if err := k.do("GET", "/api/v1/nodes", query, "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// SetNodeUnschedulable cordons or uncordons the named node.
+func (k *KubernetesClient) SetNodeUnschedulable(name string, unschedulable bool) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"unschedulable": unschedulable,
+		},
+	}
+	return k.do("PATCH", "/api/v1/nodes/"+url.PathEscape(name), nil, "application/strategic-merge-patch+json", patch, nil)
+}
+
+// ListPods returns the pods matching the field selector in every namespace.
+func (k *KubernetesClient) ListPods(fieldSelector string) ([]KubernetesPod, error) {
+	var list struct {
+		Items []KubernetesPod `json:"items"`
+	}
+	query := url.Values{}
+	if fieldSelector != "" {
+		query.Set("fieldSelector", fieldSelector)
+	}
+	if err := k.do("GET", "/api/v1/pods", query, "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// ListNodePods returns the pods bound to the named node.
+func (k *KubernetesClient) ListNodePods(nodeName string) ([]KubernetesPod, error) {
+	return k.ListPods("spec.nodeName=" + nodeName)
+}
+
+// GetPod returns the named pod.
+func (k *KubernetesClient) GetPod(namespace, name string) (*KubernetesPod, error) {
+	var pod KubernetesPod
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if err := k.do("GET", path, nil, "", nil, &pod); err != nil {
+		return nil, err
+	}
+	return &pod, nil
+}
+
+// EvictPod asks the API server to evict the pod, honoring any
+// PodDisruptionBudget that covers it. A 429 response means the eviction would
+// violate a budget and should be retried later.
+func (k *KubernetesClient) EvictPod(pod *KubernetesPod, gracePeriodSeconds *int64) error {
+	eviction := map[string]interface{}{
+		"apiVersion": "policy/v1",
+		"kind":       "Eviction",
+		"metadata": map[string]interface{}{
+			"name":      pod.Metadata.Name,
+			"namespace": pod.Metadata.Namespace,
+		},
+	}
+	if gracePeriodSeconds != nil {
+		eviction["deleteOptions"] = map[string]interface{}{
+			"gracePeriodSeconds": *gracePeriodSeconds,
+		}
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/eviction", url.PathEscape(pod.Metadata.Namespace), url.PathEscape(pod.Metadata.Name))
+	return k.do("POST", path, nil, "", eviction, nil)
+}
+
+// KubernetesWorkload is a controller that creates pods from a template, such
+// as a Deployment, StatefulSet or Job.
+type KubernetesWorkload struct {
+	Kind     string
+	Metadata KubernetesObjectMeta
+	PodSpec  KubernetesPodSpec
+}
+
+func (w *KubernetesWorkload) String() string {
+	return fmt.Sprintf("%s %s/%s", w.Kind, w.Metadata.Namespace, w.Metadata.Name)
+}
+
+// kubernetesWorkloadKinds maps the kinds of workloads with a pod template to
+// their list path.
+var kubernetesWorkloadKinds = map[string]string{
+	"Deployment":  "/apis/apps/v1/deployments",
+	"StatefulSet": "/apis/apps/v1/statefulsets",
+	"DaemonSet":   "/apis/apps/v1/daemonsets",
+	"ReplicaSet":  "/apis/apps/v1/replicasets",
+	"Job":         "/apis/batch/v1/jobs",
+	"CronJob":     "/apis/batch/v1/cronjobs",
+}
+
+// ListWorkloads returns every workload of the given kind in every namespace.
+// Workloads owned by another controller, such as the ReplicaSets of a
+// Deployment, are left out since their owner is listed as well.
+func (k *KubernetesClient) ListWorkloads(kind string) ([]KubernetesWorkload, error) {
+	path, ok := kubernetesWorkloadKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown workload kind %q", kind)
+	}
+
+	type podTemplate struct {
+		Spec KubernetesPodSpec `json:"spec"`
+	}
+	var list struct {
+		Items []struct {
+			Metadata KubernetesObjectMeta `json:"metadata"`
+			Spec     struct {
+				Template    *podTemplate `json:"template,omitempty"`
+				JobTemplate *struct {
+					Spec struct {
+						Template podTemplate `json:"template"`
+					} `json:"spec"`
+				} `json:"jobTemplate,omitempty"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := k.do("GET", path, nil, "", nil, &list); err != nil {
+		return nil, err
+	}
+
+	workloads := []KubernetesWorkload{}
+	for _, item := range list.Items {
+		if len(item.Metadata.OwnerReferences) > 0 {
+			continue
+		}
+		workload := KubernetesWorkload{
+			Kind:     kind,
+			Metadata: item.Metadata,
+		}
+		switch {
+		case item.Spec.Template != nil:
+			workload.PodSpec = item.Spec.Template.Spec
+		case item.Spec.JobTemplate != nil:
+			workload.PodSpec = item.Spec.JobTemplate.Spec.Template.Spec
+		default:
+			continue
+		}
+		workloads = append(workloads, workload)
+	}
+	return workloads, nil
+}
+
+// ListPodDisruptionBudgets returns the PodDisruptionBudgets of every
+// namespace.
+func (k *KubernetesClient) ListPodDisruptionBudgets() ([]KubernetesPodDisruptionBudget, error) {
+	var list struct {
+		Items []KubernetesPodDisruptionBudget `json:"items"`
+	}
+	if err := k.do("GET", "/apis/policy/v1/poddisruptionbudgets", nil, "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// SetNodeLabel sets a label on the named node.
+func (k *KubernetesClient) SetNodeLabel(name, key, value string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				key: value,
+			},
+		},
+	}
+	return k.do("PATCH", "/api/v1/nodes/"+url.PathEscape(name), nil, "application/strategic-merge-patch+json", patch, nil)
+}
+
+// GetNode returns the named node.
+func (k *KubernetesClient) GetNode(name string) (*KubernetesNode, error) {
+	var node KubernetesNode
+	if err := k.do("GET", "/api/v1/nodes/"+url.PathEscape(name), nil, "", nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// SetNodeTaint adds the taint to the named node, or removes any taint with
+// its key when present is false, whatever its effect. The taints of a node are a plain
+// list to the API server, so the node is read and written back whole, guarded
+// by its resource version and retried on conflicts.
+func (k *KubernetesClient) SetNodeTaint(name string, taint KubernetesTaint, present bool) error {
+	for {
+		node, err := k.GetNode(name)
+		if err != nil {
+			return err
+		}
+
+		taints := []KubernetesTaint{}
+		found := false
+		for _, t := range node.Spec.Taints {
+			if t.Key == taint.Key && !present {
+				found = true
+				continue
+			}
+			if t.Key == taint.Key && t.Effect == taint.Effect {
+				found = true
+			}
+			taints = append(taints, t)
+		}
+		if found == present {
+			return nil
+		}
+		if present {
+			taints = append(taints, taint)
+		}
+
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": node.Metadata.ResourceVersion,
+			},
+			"spec": map[string]interface{}{
+				"taints": taints,
+			},
+		}
+		err = k.do("PATCH", "/api/v1/nodes/"+url.PathEscape(name), nil, "application/merge-patch+json", patch, nil)
+		if isKubernetesApiErrorWithCode(err, 409) {
+			log.Printf("[DEBUG] Node %s changed while setting taint %s, retrying", name, taint.Key)
+			continue
+		}
+		return err
+	}
+}
+
+// kubernetesMicroTimeFormat is the layout of the MicroTime fields of Lease
+// objects.
+const kubernetesMicroTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func leasePath(namespace, name string) string {
+	path := "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(namespace) + "/leases"
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
+
+// GetLease returns the named Lease.
+func (k *KubernetesClient) GetLease(namespace, name string) (*KubernetesLease, error) {
+	var lease KubernetesLease
+	if err := k.do("GET", leasePath(namespace, name), nil, "", nil, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// CreateLease creates the Lease and returns it as stored.
+func (k *KubernetesClient) CreateLease(lease *KubernetesLease) (*KubernetesLease, error) {
+	body := *lease
+	body.APIVersion = "coordination.k8s.io/v1"
+	body.Kind = "Lease"
+	var created KubernetesLease
+	if err := k.do("POST", leasePath(lease.Metadata.Namespace, ""), nil, "", &body, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateLease replaces the Lease. It fails with a 409 if the Lease changed
+// since its resource version was read.
+func (k *KubernetesClient) UpdateLease(lease *KubernetesLease) (*KubernetesLease, error) {
+	body := *lease
+	body.APIVersion = "coordination.k8s.io/v1"
+	body.Kind = "Lease"
+	var updated KubernetesLease
+	if err := k.do("PUT", leasePath(lease.Metadata.Namespace, lease.Metadata.Name), nil, "", &body, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteLease deletes the Lease, provided it is still at the resource version
+// it was read at.
+func (k *KubernetesClient) DeleteLease(lease *KubernetesLease) error {
+	options := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "DeleteOptions",
+		"preconditions": map[string]string{
+			"resourceVersion": lease.Metadata.ResourceVersion,
+		},
+	}
+	return k.do("DELETE", leasePath(lease.Metadata.Namespace, lease.Metadata.Name), nil, "", options, nil)
+}
+
+// KubernetesObjectMeta holds the subset of object metadata the rollout uses.
+type KubernetesObjectMeta struct {
+	Name              string                     `json:"name"`
+	Namespace         string                     `json:"namespace,omitempty"`
+	UID               string                     `json:"uid,omitempty"`
+	ResourceVersion   string                     `json:"resourceVersion,omitempty"`
+	Labels            map[string]string          `json:"labels,omitempty"`
+	Annotations       map[string]string          `json:"annotations,omitempty"`
+	OwnerReferences   []KubernetesOwnerReference `json:"ownerReferences,omitempty"`
+	DeletionTimestamp *time.Time                 `json:"deletionTimestamp,omitempty"`
+	CreationTimestamp time.Time                  `json:"creationTimestamp,omitempty"`
+}
+
+type KubernetesLease struct {
+	APIVersion string               `json:"apiVersion,omitempty"`
+	Kind       string               `json:"kind,omitempty"`
+	Metadata   KubernetesObjectMeta `json:"metadata"`
+	Spec       struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int64  `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int64  `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// expiry returns when the Lease lapses unless it is renewed. A Lease that was
+// never renewed has already lapsed.
+func (l *KubernetesLease) expiry() time.Time {
+	renewed, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if err != nil {
+		return time.Time{}
+	}
+	return renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second)
+}
+
+type KubernetesOwnerReference struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Controller *bool  `json:"controller,omitempty"`
+}
+
+type KubernetesTaint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"`
+}
+
+type KubernetesCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type KubernetesNode struct {
+	Metadata KubernetesObjectMeta `json:"metadata"`
+	Spec     struct {
+		Unschedulable bool              `json:"unschedulable,omitempty"`
+		Taints        []KubernetesTaint `json:"taints,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []KubernetesCondition `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+// IsReady reports whether the node's Ready condition is True.
+func (n *KubernetesNode) IsReady() bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// zone returns the zone the node runs in, or "" if it is not labeled.
+func (n *KubernetesNode) zone() string {
+	if zone, ok := n.Metadata.Labels[kubernetesZoneLabel]; ok {
+		return zone
+	}
+	return n.Metadata.Labels[kubernetesLegacyZoneLabel]
+}
+
+type KubernetesPodSpec struct {
+	NodeName     string            `json:"nodeName,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	Affinity     *struct {
+		NodeAffinity *struct {
+			RequiredDuringSchedulingIgnoredDuringExecution *struct {
+				NodeSelectorTerms []struct {
+					MatchExpressions []struct {
+						Key      string   `json:"key"`
+						Operator string   `json:"operator"`
+						Values   []string `json:"values,omitempty"`
+					} `json:"matchExpressions,omitempty"`
+				} `json:"nodeSelectorTerms"`
+			} `json:"requiredDuringSchedulingIgnoredDuringExecution,omitempty"`
+		} `json:"nodeAffinity,omitempty"`
+	} `json:"affinity,omitempty"`
+	Volumes []struct {
+		Name     string    `json:"name"`
+		EmptyDir *struct{} `json:"emptyDir,omitempty"`
+	} `json:"volumes,omitempty"`
+}
+
+// requiresNodeLabel reports whether the pod spec can only be scheduled on
+// nodes that have the label key set to value, through either its
+// nodeSelector or its required node affinity.
+func (s *KubernetesPodSpec) requiresNodeLabel(key, value string) bool {
+	if v, ok := s.NodeSelector[key]; ok && v == value {
+		return true
+	}
+
+	if s.Affinity == nil || s.Affinity.NodeAffinity == nil || s.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return false
+	}
+	for _, term := range s.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == key && expr.Operator == "In" && stringInSlice(expr.Values, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type KubernetesPod struct {
+	Metadata KubernetesObjectMeta `json:"metadata"`
+	Spec     KubernetesPodSpec    `json:"spec"`
+	Status   struct {
+		Phase             string                `json:"phase,omitempty"`
+		Conditions        []KubernetesCondition `json:"conditions,omitempty"`
+		ContainerStatuses []struct {
+			Name  string `json:"name"`
+			Ready bool   `json:"ready"`
+			State struct {
+				Waiting *struct {
+					Reason string `json:"reason,omitempty"`
+				} `json:"waiting,omitempty"`
+			} `json:"state"`
+		} `json:"containerStatuses,omitempty"`
+	} `json:"status"`
+}
+
+// IsFinished reports whether the pod has terminated and no longer holds
+// resources on its node.
+func (p *KubernetesPod) IsFinished() bool {
+	return p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed"
+}
+
+// IsUnschedulable reports whether the pod is Pending because the scheduler
+// found no node for it.
+func (p *KubernetesPod) IsUnschedulable() bool {
+	if p.Status.Phase != "Pending" {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == "PodScheduled" {
+			return c.Status == "False"
+		}
+	}
+	return false
+}
+
+// controller returns the owner reference of the pod's managing controller,
+// if any.
+func (p *KubernetesPod) controller() *KubernetesOwnerReference {
+	for i, ref := range p.Metadata.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller {
+			return &p.Metadata.OwnerReferences[i]
+		}
+	}
+	return nil
+}
+
+func (p *KubernetesPod) hasEmptyDir() bool {
+	for _, volume := range p.Spec.Volumes {
+		if volume.EmptyDir != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *KubernetesPod) String() string {
+	return p.Metadata.Namespace + "/" + p.Metadata.Name
+}
+
+// The label GKE puts on every node with the name of its node pool.
+const gkeNodePoolLabel = "cloud.google.com/gke-nodepool"
+
+// The labels of a node's zone, current and from before Kubernetes 1.17.
+const (
+	kubernetesZoneLabel       = "topology.kubernetes.io/zone"
+	kubernetesLegacyZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+)
+
+type KubernetesPodDisruptionBudget struct {
+	Metadata KubernetesObjectMeta `json:"metadata"`
+	Spec     struct {
+		Selector *KubernetesLabelSelector `json:"selector,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		DisruptionsAllowed int64 `json:"disruptionsAllowed"`
+		CurrentHealthy     int64 `json:"currentHealthy"`
+		DesiredHealthy     int64 `json:"desiredHealthy"`
+		ExpectedPods       int64 `json:"expectedPods"`
+	} `json:"status"`
+}
+
+func (b *KubernetesPodDisruptionBudget) String() string {
+	return fmt.Sprintf("%s/%s", b.Metadata.Namespace, b.Metadata.Name)
+}
+
+// covers reports whether the budget applies to the pod. As in policy/v1, a
+// missing selector covers no pods and an empty one every pod of the budget's
+// namespace.
+func (b *KubernetesPodDisruptionBudget) covers(pod *KubernetesPod) bool {
+	if pod.Metadata.Namespace != b.Metadata.Namespace || b.Spec.Selector == nil {
+		return false
+	}
+	if len(b.Spec.Selector.MatchLabels)+len(b.Spec.Selector.MatchExpressions) == 0 {
+		return true
+	}
+	return b.Spec.Selector.matches(pod.Metadata.Labels)
+}
+
+type KubernetesLabelSelector struct {
+	MatchLabels      map[string]string `json:"matchLabels,omitempty"`
+	MatchExpressions []struct {
+		Key      string   `json:"key"`
+		Operator string   `json:"operator"`
+		Values   []string `json:"values,omitempty"`
+	} `json:"matchExpressions,omitempty"`
+}
+
+// matches reports whether the labels satisfy the selector. A nil or empty
+// selector matches nothing.
+func (s *KubernetesLabelSelector) matches(labels map[string]string) bool {
+	if s == nil || len(s.MatchLabels)+len(s.MatchExpressions) == 0 {
+		return false
+	}
+
+	for k, v := range s.MatchLabels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	for _, expr := range s.MatchExpressions {
+		value, ok := labels[expr.Key]
+		switch expr.Operator {
+		case "In":
+			if !ok || !stringInSlice(expr.Values, value) {
+				return false
+			}
+		case "NotIn":
+			if ok && stringInSlice(expr.Values, value) {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,354 @@
+package rollgcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// rolloutMetrics measures one rollout for the metrics textfile.
+type rolloutMetrics struct {
+	start      time.Time
+	phase      string
+	phaseStart time.Time
+	// phaseSeconds is how long each phase took.
+	phaseSeconds map[string]float64
+
+	podsEvicted     int
+	evictionRetries int
+
+	// retries counts the retries of the rollout's own requests to Google
+	// APIs, apart from those of operations running alongside it.
+	retries *retryCounters
+}
+
+func newRolloutMetrics() *rolloutMetrics {
+	return &rolloutMetrics{
+		phaseSeconds: map[string]float64{},
+		retries:      newRetryCounters(),
+	}
+}
+
+func (m *rolloutMetrics) begin() {
+	m.start = time.Now()
+}
+
+// enterPhase ends the timing of the previous phase and starts that of phase.
+func (m *rolloutMetrics) enterPhase(phase string) {
+	now := time.Now()
+	if m.phase != "" {
+		m.phaseSeconds[m.phase] += now.Sub(m.phaseStart).Seconds()
+	}
+	m.phase = phase
+	m.phaseStart = now
+	if phase == rolloutPhaseDone {
+		m.phase = ""
+	}
+}
+
+// poolMetricsKey holds the labels every metric of a node pool carries.
+type poolMetricsKey struct {
+	project string
+	cluster string
+	pool    string
+}
+
+func (k poolMetricsKey) labels() string {
+	return fmt.Sprintf(`project="%s",cluster="%s",pool="%s"`, escapeMetricLabel(k.project), escapeMetricLabel(k.cluster), escapeMetricLabel(k.pool))
+}
+
+// poolMetrics are the metrics of one node pool. Durations are those of its
+// last rollout; the counts add up over every operation of the process.
+type poolMetrics struct {
+	phaseSeconds    map[string]float64
+	rolloutSeconds  float64
+	podsEvicted     int
+	evictionRetries int
+	apiRetries      map[string]int
+	failures        map[string]int
+
+	// surgeNodes and surgeNodesUpgraded count the nodes of the last GKE
+	// surge upgrade, and those of them that were upgraded.
+	surgeNodes         int
+	surgeNodesUpgraded int
+}
+
+// metricsRegistry collects the metrics of the node pools a Config operates
+// on and writes them to a file in the Prometheus text format, for the
+// textfile collector of node_exporter. A nil registry does nothing.
+type metricsRegistry struct {
+	path string
+
+	lock  sync.Mutex
+	pools map[poolMetricsKey]*poolMetrics
+}
+
+func newMetricsRegistry(path string) *metricsRegistry {
+	if path == "" {
+		return nil
+	}
+	return &metricsRegistry{
+		path:  path,
+		pools: map[poolMetricsKey]*poolMetrics{},
+	}
+}
+
+// pool returns the metrics of the node pool. The caller must hold the lock.
+func (r *metricsRegistry) pool(key poolMetricsKey) *poolMetrics {
+	p, ok := r.pools[key]
+	if !ok {
+		p = &poolMetrics{
+			phaseSeconds: map[string]float64{},
+			apiRetries:   map[string]int{},
+			failures:     map[string]int{},
+		}
+		r.pools[key] = p
+	}
+	return p
+}
+
+// recordRollout adds a finished rollout to the metrics of its node pool. If
+// err is set, the rollout counts as failed at the phase it was in.
+func (r *metricsRegistry) recordRollout(key poolMetricsKey, m *rolloutMetrics, err error) {
+	if r == nil {
+		return
+	}
+	failedPhase := m.phase
+	if failedPhase == "" {
+		// The checks made before the first phase.
+		failedPhase = "start"
+	}
+	m.enterPhase(rolloutPhaseDone)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p := r.pool(key)
+	p.phaseSeconds = m.phaseSeconds
+	p.rolloutSeconds = time.Since(m.start).Seconds()
+	p.podsEvicted += m.podsEvicted
+	p.evictionRetries += m.evictionRetries
+	for predicate, count := range m.retries.snapshot() {
+		p.apiRetries[predicate] += count
+	}
+	if err != nil {
+		p.failures[failedPhase]++
+	}
+}
+
+func (r *metricsRegistry) recordFailure(key poolMetricsKey, step string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pool(key).failures[step]++
+}
+
+// recordSurgeProgress records how far GKE's surge upgrade of the node pool
+// has got.
+func (r *metricsRegistry) recordSurgeProgress(key poolMetricsKey, upgraded, total int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p := r.pool(key)
+	p.surgeNodes = total
+	p.surgeNodesUpgraded = upgraded
+}
+
+func (r *metricsRegistry) failureCount(key poolMetricsKey) int {
+	if r == nil {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	count := 0
+	if p, ok := r.pools[key]; ok {
+		for _, n := range p.failures {
+			count += n
+		}
+	}
+	return count
+}
+
+// write replaces the metrics file. It is written next to its final path and
+// renamed into place, so that the collector never reads half a file.
+func (r *metricsRegistry) write() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	text := r.text()
+	r.lock.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), "."+filepath.Base(r.path)+".")
+	if err != nil {
+		log.Printf("[WARN] Unable to write metrics to %s: %s", r.path, err)
+		return
+	}
+	_, err = tmp.Write(text)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// TempFile creates the file readable by its owner only.
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("[WARN] Unable to write metrics to %s: %s", r.path, err)
+		return
+	}
+	log.Printf("[DEBUG] Wrote metrics of %d NodePools to %s", len(r.pools), r.path)
+}
+
+// text renders the metrics in the Prometheus text format. The caller must
+// hold the lock.
+func (r *metricsRegistry) text() []byte {
+	keys := make([]poolMetricsKey, 0, len(r.pools))
+	for k := range r.pools {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].labels() < keys[j].labels()
+	})
+
+	var buf bytes.Buffer
+	family := func(name, kind, help string, samples func(k poolMetricsKey, p *poolMetrics)) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, k := range keys {
+			samples(k, r.pools[k])
+		}
+	}
+
+	family("rollgcp_rollout_duration_seconds", "gauge", "Duration of the last rollout of the node pool.", func(k poolMetricsKey, p *poolMetrics) {
+		if p.rolloutSeconds > 0 {
+			fmt.Fprintf(&buf, "rollgcp_rollout_duration_seconds{%s} %g\n", k.labels(), p.rolloutSeconds)
+		}
+	})
+	family("rollgcp_rollout_phase_duration_seconds", "gauge", "Duration of each phase of the last rollout of the node pool.", func(k poolMetricsKey, p *poolMetrics) {
+		for _, phase := range sortedKeys(p.phaseSeconds) {
+			fmt.Fprintf(&buf, "rollgcp_rollout_phase_duration_seconds{%s,phase=\"%s\"} %g\n", k.labels(), escapeMetricLabel(phase), p.phaseSeconds[phase])
+		}
+	})
+	family("rollgcp_rollout_pods_evicted_total", "counter", "Pods evicted from the nodes of the node pool.", func(k poolMetricsKey, p *poolMetrics) {
+		fmt.Fprintf(&buf, "rollgcp_rollout_pods_evicted_total{%s} %d\n", k.labels(), p.podsEvicted)
+	})
+	family("rollgcp_rollout_eviction_retries_total", "counter", "Evictions retried because a PodDisruptionBudget blocked them.", func(k poolMetricsKey, p *poolMetrics) {
+		fmt.Fprintf(&buf, "rollgcp_rollout_eviction_retries_total{%s} %d\n", k.labels(), p.evictionRetries)
+	})
+	family("rollgcp_api_retries_total", "counter", "API requests retried during rollouts of the node pool, by the retry predicate that allowed them.", func(k poolMetricsKey, p *poolMetrics) {
+		for _, predicate := range sortedKeys(p.apiRetries) {
+			fmt.Fprintf(&buf, "rollgcp_api_retries_total{%s,predicate=\"%s\"} %d\n", k.labels(), escapeMetricLabel(predicate), p.apiRetries[predicate])
+		}
+	})
+	family("rollgcp_surge_upgrade_nodes", "gauge", "Nodes of the last GKE surge upgrade of the node pool.", func(k poolMetricsKey, p *poolMetrics) {
+		if p.surgeNodes > 0 {
+			fmt.Fprintf(&buf, "rollgcp_surge_upgrade_nodes{%s} %d\n", k.labels(), p.surgeNodes)
+		}
+	})
+	family("rollgcp_surge_upgrade_nodes_upgraded", "gauge", "Nodes of the last GKE surge upgrade of the node pool that run its current instance template.", func(k poolMetricsKey, p *poolMetrics) {
+		if p.surgeNodes > 0 {
+			fmt.Fprintf(&buf, "rollgcp_surge_upgrade_nodes_upgraded{%s} %d\n", k.labels(), p.surgeNodesUpgraded)
+		}
+	})
+	family("rollgcp_failures_total", "counter", "Failed operations on the node pool, by the rollout phase or operation that failed.", func(k poolMetricsKey, p *poolMetrics) {
+		for _, step := range sortedKeys(p.failures) {
+			fmt.Fprintf(&buf, "rollgcp_failures_total{%s,step=\"%s\"} %d\n", k.labels(), escapeMetricLabel(step), p.failures[step])
+		}
+	})
+
+	return buf.Bytes()
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]int:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricLabel(v string) string {
+	return metricLabelEscaper.Replace(v)
+}
+
+// nodePoolMetricsKey returns the labels of the node pool of the resource,
+// if they can be told.
+func nodePoolMetricsKey(d *schema.ResourceData, config *Config) (poolMetricsKey, bool) {
+	nodePoolInfo, err := extractNodePoolInformation(d, config)
+	if err != nil {
+		return poolMetricsKey{}, false
+	}
+	pool := d.Get("name").(string)
+	if d.Id() != "" {
+		pool = getNodePoolName(d.Id())
+	}
+	if pool == "" {
+		return poolMetricsKey{}, false
+	}
+	return poolMetricsKey{
+		project: nodePoolInfo.project,
+		cluster: nodePoolInfo.cluster,
+		pool:    pool,
+	}, true
+}
+
+// withNodePoolMetrics wraps an operation of the node pool resource to count
+// its failure under step and to write the metrics file once it returns.
+func withNodePoolMetrics(step string, f func(*schema.ResourceData, interface{}) error) func(*schema.ResourceData, interface{}) error {
+	return func(d *schema.ResourceData, meta interface{}) error {
+		err := f(d, meta)
+		config := meta.(*Config)
+		if err != nil {
+			if key, ok := nodePoolMetricsKey(d, config); ok {
+				config.metrics.recordFailure(key, step)
+			}
+		}
+		config.metrics.write()
+		return err
+	}
+}
+
+// withNodePoolMetricsContext is withNodePoolMetrics for operations that
+// return diagnostics. Failures a rollout already counted by phase are not
+// counted again.
+func withNodePoolMetricsContext(step string, f func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics) func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics {
+	return func(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+		config := meta.(*Config)
+		key, ok := nodePoolMetricsKey(d, config)
+		before := config.metrics.failureCount(key)
+
+		diags := f(ctx, d, meta)
+		if diags.HasError() && ok && config.metrics.failureCount(key) == before {
+			config.metrics.recordFailure(key, step)
+		}
+		config.metrics.write()
+		return diags
+	}
+}
@@ -0,0 +1,328 @@
+package rollgcp
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// The upstream resource type migrated from and the type migrated to.
+const (
+	upstreamNodePoolResourceType = "google_container_node_pool"
+	rollgcpNodePoolResourceType  = "rollgcp_container_node_pool"
+)
+
+// Attributes of the upstream resource that have no counterpart to check in
+// the schema, by path without block indices: those Terraform manages itself
+// and those the upstream resource only ever computes, which no configuration
+// sets.
+var migrateStateIgnoredAttributes = map[string]bool{
+	"id":                           true,
+	"timeouts":                     true,
+	"managed_instance_group_urls":  true,
+	"operation":                    true,
+	"node_config.effective_taints": true,
+}
+
+// Attributes of the upstream resource that it computes unless they are
+// configured, so that every state has values for them. They are reported
+// rather than refused: if the configuration sets them, the setting is lost.
+var migrateStateDefaultedAttributes = map[string]bool{
+	"network_config":              true,
+	"node_config.logging_variant": true,
+	"node_config.kubelet_config.insecure_kubelet_readonly_port_enabled": true,
+	"node_config.workload_metadata_config.mode":                         true,
+	"upgrade_settings.strategy":                                         true,
+}
+
+// migratedNodePool is a google_container_node_pool instance found in a state
+// or plan file.
+type migratedNodePool struct {
+	address    string
+	attributes map[string]interface{}
+}
+
+// MigrateState implements the migrate-state command. It reads a Terraform
+// state file (format version 4) or the JSON output of terraform show, and
+// prints what moves every google_container_node_pool onto a
+// rollgcp_container_node_pool without destroying it: terraform state rm and
+// terraform import commands, or removed and import blocks with -format=hcl.
+// It returns the process exit code.
+func MigrateState(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate-state", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "commands", `The output format, "commands" or "hcl".`)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: terraform-provider-rollgcp migrate-state [-format=commands|hcl] <terraform.tfstate | plan.json>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*format != "commands" && *format != "hcl") {
+		flags.Usage()
+		return 2
+	}
+
+	raw, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "Error reading %s: %s\n", flags.Arg(0), err)
+		return 1
+	}
+
+	nodePools, err := readMigratedNodePools(raw)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error parsing %s: %s\n", flags.Arg(0), err)
+		return 1
+	}
+	if len(nodePools) == 0 {
+		fmt.Fprintf(stderr, "No %s resources found in %s\n", upstreamNodePoolResourceType, flags.Arg(0))
+		return 1
+	}
+
+	failed := false
+	for _, nodePool := range nodePools {
+		problems, warnings := validateMigratedAttributes(resourceContainerNodePool().Schema, nodePool.attributes, "", "")
+		for _, warning := range warnings {
+			fmt.Fprintf(stderr, "%s: warning: %s\n", nodePool.address, warning)
+		}
+		for _, problem := range problems {
+			fmt.Fprintf(stderr, "%s: %s\n", nodePool.address, problem)
+			failed = true
+		}
+	}
+	if failed {
+		fmt.Fprintf(stderr, "Some attributes have no counterpart in %s; nothing was generated\n", rollgcpNodePoolResourceType)
+		return 1
+	}
+
+	removed := map[string]bool{}
+	for _, nodePool := range nodePools {
+		id, err := migratedNodePoolId(nodePool.attributes)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", nodePool.address, err)
+			return 1
+		}
+		to := migratedAddress(nodePool.address)
+
+		if *format == "hcl" {
+			if from := removedAddress(nodePool.address); !removed[from] {
+				fmt.Fprintf(stdout, "removed {\n  from = %s\n\n  lifecycle {\n    destroy = false\n  }\n}\n\n", from)
+				removed[from] = true
+			}
+			fmt.Fprintf(stdout, "import {\n  to = %s\n  id = %q\n}\n\n", to, id)
+		} else {
+			fmt.Fprintf(stdout, "terraform state rm '%s'\n", nodePool.address)
+			fmt.Fprintf(stdout, "terraform import '%s' '%s'\n", to, id)
+		}
+	}
+
+	return 0
+}
+
+// readMigratedNodePools returns the managed google_container_node_pool
+// instances of a state file or of terraform show -json output, sorted by
+// address.
+func readMigratedNodePools(raw []byte) ([]migratedNodePool, error) {
+	var doc struct {
+		Version   int                      `json:"version"`
+		Resources []map[string]interface{} `json:"resources"`
+
+		FormatVersion string                 `json:"format_version"`
+		PriorState    map[string]interface{} `json:"prior_state"`
+		Values        map[string]interface{} `json:"values"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	var nodePools []migratedNodePool
+	switch {
+	case doc.FormatVersion != "":
+		values := doc.Values
+		if doc.PriorState != nil {
+			values, _ = doc.PriorState["values"].(map[string]interface{})
+		}
+		if values != nil {
+			module, _ := values["root_module"].(map[string]interface{})
+			nodePools = readShowModule(module)
+		}
+	case doc.Version == 4:
+		nodePools = readStateResources(doc.Resources)
+	default:
+		return nil, fmt.Errorf("not a version 4 state file or terraform show -json output")
+	}
+
+	sort.Slice(nodePools, func(i, j int) bool {
+		return nodePools[i].address < nodePools[j].address
+	})
+	return nodePools, nil
+}
+
+func readStateResources(resources []map[string]interface{}) []migratedNodePool {
+	var nodePools []migratedNodePool
+	for _, r := range resources {
+		if r["mode"] != "managed" || r["type"] != upstreamNodePoolResourceType {
+			continue
+		}
+
+		prefix := ""
+		if module, ok := r["module"].(string); ok && module != "" {
+			prefix = module + "."
+		}
+		base := fmt.Sprintf("%s%s.%s", prefix, upstreamNodePoolResourceType, r["name"])
+
+		instances, _ := r["instances"].([]interface{})
+		for _, raw := range instances {
+			instance, _ := raw.(map[string]interface{})
+			attributes, _ := instance["attributes"].(map[string]interface{})
+			if attributes == nil {
+				continue
+			}
+			nodePools = append(nodePools, migratedNodePool{
+				address:    base + formatIndexKey(instance["index_key"]),
+				attributes: attributes,
+			})
+		}
+	}
+	return nodePools
+}
+
+func readShowModule(module map[string]interface{}) []migratedNodePool {
+	if module == nil {
+		return nil
+	}
+
+	var nodePools []migratedNodePool
+	resources, _ := module["resources"].([]interface{})
+	for _, raw := range resources {
+		r, _ := raw.(map[string]interface{})
+		if r["mode"] != "managed" || r["type"] != upstreamNodePoolResourceType {
+			continue
+		}
+		attributes, _ := r["values"].(map[string]interface{})
+		if attributes == nil {
+			continue
+		}
+		nodePools = append(nodePools, migratedNodePool{
+			address:    r["address"].(string),
+			attributes: attributes,
+		})
+	}
+
+	children, _ := module["child_modules"].([]interface{})
+	for _, raw := range children {
+		child, _ := raw.(map[string]interface{})
+		nodePools = append(nodePools, readShowModule(child)...)
+	}
+	return nodePools
+}
+
+func formatIndexKey(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return fmt.Sprintf("[%q]", k)
+	case float64:
+		return fmt.Sprintf("[%d]", int(k))
+	}
+	return ""
+}
+
+// migratedAddress returns the address of the rollgcp resource replacing the
+// upstream resource at address.
+func migratedAddress(address string) string {
+	i := strings.LastIndex(address, upstreamNodePoolResourceType+".")
+	return address[:i] + rollgcpNodePoolResourceType + address[i+len(upstreamNodePoolResourceType):]
+}
+
+// removedAddress strips the instance key from address, since removed blocks
+// refer to whole resources.
+func removedAddress(address string) string {
+	if i := strings.LastIndex(address, "["); i > strings.LastIndex(address, upstreamNodePoolResourceType+".") {
+		return address[:i]
+	}
+	return address
+}
+
+func migratedNodePoolId(attributes map[string]interface{}) (string, error) {
+	values := map[string]string{}
+	for _, k := range []string{"project", "location", "cluster", "name"} {
+		v, _ := attributes[k].(string)
+		if v == "" {
+			return "", fmt.Errorf("attribute %s is not set, so the import ID cannot be built", k)
+		}
+		values[k] = v
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s/nodePools/%s", values["project"], values["location"], values["cluster"], values["name"]), nil
+}
+
+// validateMigratedAttributes checks that every attribute with a value has a
+// counterpart in the schema, descending into nested blocks. Unset attributes
+// are allowed, since the upstream provider may know fields this copy lacks.
+// Attributes the upstream resource computes by default are returned as
+// warnings instead. path is that of the block with indices, for messages,
+// and schemaPath the same without them.
+func validateMigratedAttributes(s map[string]*schema.Schema, attributes map[string]interface{}, path, schemaPath string) (problems, warnings []string) {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := attributes[k]
+		if migrateStateIgnoredAttributes[schemaPath+k] {
+			continue
+		}
+		attrSchema, ok := s[k]
+		if !ok {
+			switch {
+			case isEmptyAttributeValue(v):
+			case migrateStateDefaultedAttributes[schemaPath+k]:
+				value, _ := json.Marshal(v)
+				warnings = append(warnings, fmt.Sprintf("attribute %s%s = %s is not supported and is left as GKE set it; remove it from the configuration", path, k, value))
+			default:
+				problems = append(problems, fmt.Sprintf("attribute %s%s is not supported", path, k))
+			}
+			continue
+		}
+
+		nested, ok := attrSchema.Elem.(*schema.Resource)
+		if !ok {
+			continue
+		}
+		blocks, _ := v.([]interface{})
+		for i, raw := range blocks {
+			block, _ := raw.(map[string]interface{})
+			p, w := validateMigratedAttributes(nested.Schema, block, fmt.Sprintf("%s%s.%d.", path, k, i), schemaPath+k+".")
+			problems = append(problems, p...)
+			warnings = append(warnings, w...)
+		}
+	}
+
+	return problems, warnings
+}
+
+func isEmptyAttributeValue(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case bool:
+		return !value
+	case float64:
+		return value == 0
+	case []interface{}:
+		return len(value) == 0
+	case map[string]interface{}:
+		return len(value) == 0
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package rollgcp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const upstreamStateFixture = "testdata/google_container_node_pool.tfstate"
+
+func TestMigrateStateUpstreamState(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := MigrateState([]string{upstreamStateFixture}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d:\n%s", code, stderr.String())
+	}
+
+	want := "terraform state rm 'google_container_node_pool.primary'\n" +
+		"terraform import 'rollgcp_container_node_pool.primary' 'projects/my-project/locations/us-central1/clusters/my-cluster/nodePools/primary'\n"
+	if stdout.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, stdout.String())
+	}
+
+	// Attributes the upstream resource always computes are ignored, and
+	// those it only defaults are reported.
+	for _, attr := range []string{"managed_instance_group_urls", "effective_taints", "operation"} {
+		if strings.Contains(stderr.String(), attr) {
+			t.Errorf("expected computed attribute %s to be ignored, got:\n%s", attr, stderr.String())
+		}
+	}
+	for _, attr := range []string{"network_config", "node_config.0.logging_variant", "node_config.0.workload_metadata_config.0.mode", "upgrade_settings.0.strategy"} {
+		if !strings.Contains(stderr.String(), "warning: attribute "+attr+" ") {
+			t.Errorf("expected a warning about %s, got:\n%s", attr, stderr.String())
+		}
+	}
+}
+
+func TestMigrateStateRefusesLostSettings(t *testing.T) {
+	raw, err := ioutil.ReadFile(upstreamStateFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Spot VMs can be configured upstream but not here.
+	raw = bytes.Replace(raw, []byte(`"spot": false`), []byte(`"spot": true`), 1)
+	dir, err := ioutil.TempDir("", "rollgcp-migrate-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "terraform.tfstate")
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := MigrateState([]string{path}, &stdout, &stderr); code != 1 {
+		t.Fatalf("expected exit code 1, got %d", code)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected nothing to be generated, got:\n%s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "attribute node_config.0.spot is not supported") {
+		t.Errorf("expected node_config.0.spot to be refused, got:\n%s", stderr.String())
+	}
+}
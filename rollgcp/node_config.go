@@ -268,6 +268,40 @@ func schemaNodeConfig() *schema.Schema {
 					},
 				},
 
+				"reservation_affinity": {
+					Type:     schema.TypeList,
+					Optional: true,
+					ForceNew: false,
+					MaxItems: 1,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							"consume_reservation_type": {
+								Type:         schema.TypeString,
+								Required:     true,
+								ForceNew:     false,
+								ValidateFunc: validation.StringInSlice([]string{"UNSPECIFIED", "NO_RESERVATION", "ANY_RESERVATION", "SPECIFIC_RESERVATION"}, false),
+							},
+							"key": {
+								Type:     schema.TypeString,
+								Optional: true,
+								ForceNew: false,
+							},
+							"values": {
+								Type:     schema.TypeSet,
+								Optional: true,
+								ForceNew: false,
+								Elem:     &schema.Schema{Type: schema.TypeString},
+							},
+						},
+					},
+				},
+
+				"node_group": {
+					Type:     schema.TypeString,
+					Optional: true,
+					ForceNew: false,
+				},
+
 				"linux_node_config": {
 					Type:     schema.TypeList,
 					Optional: true,
@@ -429,6 +463,14 @@ func expandNodeConfig(v interface{}) *containerBeta.NodeConfig {
 		nc.LinuxNodeConfig = expandLinuxNodeConfig(v)
 	}
 
+	if v, ok := nodeConfig["reservation_affinity"]; ok {
+		nc.ReservationAffinity = expandReservationAffinity(v)
+	}
+
+	if v, ok := nodeConfig["node_group"]; ok {
+		nc.NodeGroup = v.(string)
+	}
+
 	return nc
 }
 
@@ -491,6 +533,22 @@ func expandLinuxNodeConfig(v interface{}) *containerBeta.LinuxNodeConfig {
 	}
 }
 
+func expandReservationAffinity(v interface{}) *containerBeta.ReservationAffinity {
+	if v == nil {
+		return nil
+	}
+	ls := v.([]interface{})
+	if len(ls) == 0 {
+		return nil
+	}
+	cfg := ls[0].(map[string]interface{})
+	return &containerBeta.ReservationAffinity{
+		ConsumeReservationType: cfg["consume_reservation_type"].(string),
+		Key:                    cfg["key"].(string),
+		Values:                 convertStringSet(cfg["values"].(*schema.Set)),
+	}
+}
+
 func flattenNodeConfig(c *containerBeta.NodeConfig) []map[string]interface{} {
 	config := make([]map[string]interface{}, 0, 1)
 
@@ -518,6 +576,8 @@ func flattenNodeConfig(c *containerBeta.NodeConfig) []map[string]interface{} {
 		"boot_disk_kms_key":        c.BootDiskKmsKey,
 		"kubelet_config":           flattenKubeletConfig(c.KubeletConfig),
 		"linux_node_config":        flattenLinuxNodeConfig(c.LinuxNodeConfig),
+		"reservation_affinity":     flattenReservationAffinity(c.ReservationAffinity),
+		"node_group":               c.NodeGroup,
 	})
 
 	if len(c.OauthScopes) > 0 {
@@ -716,3 +776,15 @@ func flattenLinuxNodeConfig(c *containerBeta.LinuxNodeConfig) []map[string]inter
 	}
 	return result
 }
+
+func flattenReservationAffinity(c *containerBeta.ReservationAffinity) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	if c != nil {
+		result = append(result, map[string]interface{}{
+			"consume_reservation_type": c.ConsumeReservationType,
+			"key":                      c.Key,
+			"values":                   schema.NewSet(schema.HashString, convertStringArrToInterface(c.Values)),
+		})
+	}
+	return result
+}
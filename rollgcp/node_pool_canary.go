@@ -0,0 +1,292 @@
+package rollgcp
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+// How often the canary gates are checked while soaking.
+const canaryGatePollInterval = 30 * time.Second
+
+var schemaNodePoolCanary = &schema.Schema{
+	Type:        schema.TypeList,
+	Optional:    true,
+	MaxItems:    1,
+	Description: `Runs a canary phase before the workloads are moved off the original node pool. The temporary node pool is created with a few nodes, part of the original nodes are drained onto it, and the rollout only proceeds if the cluster stays healthy for the soak duration. Otherwise the drained nodes are uncordoned and the temporary node pool is deleted.`,
+	Elem: &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"nodes": {
+				Type:         schema.TypeInt,
+				Required:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  `The number of canary nodes per zone to create with the new configuration.`,
+			},
+
+			"drain_percent": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      10,
+				ValidateFunc: validation.IntBetween(1, 100),
+				Description:  `The share of the original node pool's nodes, in percent, to drain onto the canary nodes.`,
+			},
+
+			"soak_duration": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "10m",
+				ValidateFunc: validateNonNegativeDuration(),
+				Description:  `How long the canary must stay healthy before the rollout proceeds.`,
+			},
+
+			"health_check_url": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.IsURLWithHTTPorHTTPS,
+				Description:  `A URL that must answer with a 2xx status throughout the soak.`,
+			},
+		},
+	},
+}
+
+type canarySettings struct {
+	nodes          int64
+	drainPercent   int
+	soakDuration   time.Duration
+	healthCheckURL string
+}
+
+func expandCanarySettings(v interface{}) (*canarySettings, error) {
+	ls, ok := v.([]interface{})
+	if !ok || len(ls) == 0 || ls[0] == nil {
+		return nil, nil
+	}
+
+	cfg := ls[0].(map[string]interface{})
+	settings := &canarySettings{
+		nodes:          int64(cfg["nodes"].(int)),
+		drainPercent:   cfg["drain_percent"].(int),
+		healthCheckURL: cfg["health_check_url"].(string),
+	}
+
+	soak, err := time.ParseDuration(cfg["soak_duration"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse duration from 'soak_duration' value %q", cfg["soak_duration"])
+	}
+	settings.soakDuration = soak
+
+	return settings, nil
+}
+
+// runCanary creates the node pool to with the canary node count, drains a
+// share of the nodes of the pool named from onto it and soaks. If a gate
+// fails, the drained nodes are uncordoned, the canary pool is deleted and an
+// error is returned. On success it returns the canary pool's size per zone.
+func (r *nodePoolRollout) runCanary(from string, to *containerBeta.NodePool, size int64) (int64, error) {
+	canary := r.canary
+	nodeCount := min64(canary.nodes, size)
+
+	log.Printf("[INFO] Starting canary of NodePool %s with %d nodes per zone", to.Name, nodeCount)
+
+	spec := *to
+	spec.InitialNodeCount = nodeCount
+	// A failed create may still leave the pool behind, half created.
+	if err := r.createNodePool(&spec); err != nil {
+		return 0, r.revertCanary(to.Name, nil, err)
+	}
+
+	toZones, err := r.zoneCount(to.Name)
+	if err != nil {
+		return 0, r.revertCanary(to.Name, nil, err)
+	}
+	if err := r.awaitReadyNodes(to.Name, nodeCount*toZones); err != nil {
+		return 0, r.revertCanary(to.Name, nil, err)
+	}
+	if err := r.labelTemporaryNodes(to.Name); err != nil {
+		return 0, r.revertCanary(to.Name, nil, err)
+	}
+
+	fromNodes, err := r.listNodePoolNodes(from)
+	if err != nil {
+		return 0, r.revertCanary(to.Name, nil, err)
+	}
+	fromNodes = interleaveZones(fromNodes)
+	drainCount := int(math.Ceil(float64(len(fromNodes)*canary.drainPercent) / 100))
+	drained := []string{}
+	for i := range fromNodes {
+		if len(drained) >= drainCount {
+			break
+		}
+		done, err := r.isDrained(&fromNodes[i])
+		if err != nil {
+			return 0, r.revertCanary(to.Name, nil, err)
+		}
+		if !done {
+			drained = append(drained, fromNodes[i].Metadata.Name)
+		}
+	}
+
+	evictedBefore := len(r.evicted)
+	if len(drained) > 0 {
+		log.Printf("[INFO] Draining canary share %v of NodePool %s", drained, from)
+		if err := r.setDrainingTaint(drained, true); err != nil {
+			return 0, r.revertCanary(to.Name, drained, err)
+		}
+		if err := r.drainNodes(drained); err != nil {
+			return 0, r.revertCanary(to.Name, drained, err)
+		}
+	}
+
+	if err := r.soakCanary(to.Name, r.evicted[evictedBefore:]); err != nil {
+		return 0, r.revertCanary(to.Name, drained, err)
+	}
+
+	log.Printf("[INFO] Canary of NodePool %s passed", to.Name)
+	return nodeCount, nil
+}
+
+// soakCanary checks the canary gates until the soak duration has passed. Node
+// readiness, crash looping pods and the health check URL must hold throughout;
+// pods may only be Pending while the soak is still running. evicted are the
+// pods the canary drained off the original nodes.
+func (r *nodePoolRollout) soakCanary(name string, evicted []KubernetesPod) error {
+	end := time.Now().Add(r.canary.soakDuration)
+	log.Printf("[INFO] Soaking canary NodePool %s for %s", name, r.canary.soakDuration)
+
+	for {
+		final := !time.Now().Before(end)
+		if err := r.checkCanaryGates(name, evicted, final); err != nil {
+			return fmt.Errorf("canary of NodePool %s failed: %s", name, err)
+		}
+		if final {
+			return nil
+		}
+
+		wait := canaryGatePollInterval
+		if remaining := time.Until(end); remaining < wait {
+			wait = remaining
+		}
+		if r.timeout() < wait {
+			return fmt.Errorf("timed out soaking canary NodePool %s", name)
+		}
+
+		select {
+		case <-r.config.context.Done():
+			return r.config.context.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// checkCanaryGates checks the canary once. Pending pods fail the final check
+// both on the canary nodes and unbound, if the scheduler could not place them
+// and they share a namespace with the canary's pods or the pods it evicted,
+// which covers the replacements of both.
+func (r *nodePoolRollout) checkCanaryGates(name string, evicted []KubernetesPod, final bool) error {
+	nodes, err := r.listNodePoolNodes(name)
+	if err != nil {
+		return err
+	}
+
+	namespaces := map[string]bool{}
+	for i := range evicted {
+		namespaces[evicted[i].Metadata.Namespace] = true
+	}
+
+	for i := range nodes {
+		node := &nodes[i]
+		if !node.IsReady() {
+			return fmt.Errorf("node %s is not Ready", node.Metadata.Name)
+		}
+
+		pods, err := r.kube.ListNodePods(node.Metadata.Name)
+		if err != nil {
+			return err
+		}
+		for j := range pods {
+			pod := &pods[j]
+			namespaces[pod.Metadata.Namespace] = true
+			if final && pod.Status.Phase == "Pending" {
+				return fmt.Errorf("pod %s on node %s is still Pending", pod, node.Metadata.Name)
+			}
+			for _, status := range pod.Status.ContainerStatuses {
+				if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+					return fmt.Errorf("container %s of pod %s on node %s is in CrashLoopBackOff", status.Name, pod, node.Metadata.Name)
+				}
+			}
+		}
+	}
+
+	if final {
+		// Pods the canary pushed out that fit nowhere are never bound to a
+		// node, canary or not.
+		pending, err := r.kube.ListPods("status.phase=Pending")
+		if err != nil {
+			return err
+		}
+		for i := range pending {
+			pod := &pending[i]
+			if pod.IsUnschedulable() && namespaces[pod.Metadata.Namespace] {
+				return fmt.Errorf("pod %s is still Pending and cannot be scheduled", pod)
+			}
+		}
+	}
+
+	if r.canary.healthCheckURL != "" {
+		if err := checkHealthURL(r.canary.healthCheckURL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkHealthURL(healthURL string) error {
+	client := cleanhttp.DefaultClient()
+	client.Timeout = 10 * time.Second
+
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		return fmt.Errorf("health check %s failed: %s", healthURL, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check %s returned %s", healthURL, resp.Status)
+	}
+	return nil
+}
+
+// revertCanary uncordons and untaints the drained nodes and deletes the
+// canary node pool, if it exists. It returns cause, annotated with any error
+// hit while reverting.
+func (r *nodePoolRollout) revertCanary(name string, drained []string, cause error) error {
+	log.Printf("[WARN] Reverting canary NodePool %s: %s", name, cause)
+
+	for _, nodeName := range drained {
+		if err := r.kube.SetNodeUnschedulable(nodeName, false); err != nil {
+			return fmt.Errorf("%s; additionally, uncordoning node %s failed: %s", cause, nodeName, err)
+		}
+	}
+	if err := r.setDrainingTaint(drained, false); err != nil {
+		return fmt.Errorf("%s; additionally, %s", cause, err)
+	}
+
+	_, err := r.config.refreshNodePool(r.nodePoolInfo.fullyQualifiedName(name), r.nodePoolInfo.project, r.userAgent)
+	if err != nil && !isGoogleApiErrorWithCode(err, 404) {
+		return fmt.Errorf("%s; additionally, reading canary NodePool %s failed: %s", cause, name, err)
+	}
+	if err == nil {
+		if err := containerNodePoolDelete(r.config, r.nodePoolInfo, name, r.userAgent, r.timeout()); err != nil {
+			return fmt.Errorf("%s; additionally, deleting canary NodePool %s failed: %s", cause, name, err)
+		}
+	}
+
+	return fmt.Errorf("%s; the canary was rolled back", cause)
+}
@@ -0,0 +1,345 @@
+package rollgcp
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+// The annotation the kubelet puts on the API server copy of a static pod.
+const kubernetesMirrorPodAnnotation = "kubernetes.io/config.mirror"
+
+var schemaNodePoolDrain = &schema.Schema{
+	Type:        schema.TypeList,
+	Optional:    true,
+	MaxItems:    1,
+	Description: `Controls which pods are evicted when nodes are drained during a rollout. The options behave like the flags of the same name of kubectl drain.`,
+	Elem: &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"ignore_daemonsets": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: `Skip DaemonSet-managed pods. If false, draining a node that runs DaemonSet pods fails.`,
+			},
+
+			"delete_emptydir_data": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: `Evict pods using emptyDir volumes, whose data is lost. If false, draining a node that runs such pods fails.`,
+			},
+
+			"force_unmanaged_pods": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: `Evict pods that are not managed by a controller, which will not be recreated. If false, draining a node that runs such pods fails.`,
+			},
+
+			"grace_period_seconds": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      -1,
+				ValidateFunc: validation.IntAtLeast(-1),
+				Description:  `The termination grace period given to evicted pods. If negative, the grace period of each pod is used.`,
+			},
+
+			"pod_selector_skip": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateLabelSelector,
+				Description:  `A label selector, such as "app=batch,tier!=web". Pods it matches are left on the node.`,
+			},
+		},
+	},
+}
+
+type drainSettings struct {
+	ignoreDaemonSets   bool
+	deleteEmptyDirData bool
+	forceUnmanagedPods bool
+	gracePeriodSeconds *int64
+	podSelectorSkip    labelSelector
+}
+
+func expandDrainSettings(v interface{}) (*drainSettings, error) {
+	settings := &drainSettings{
+		ignoreDaemonSets: true,
+	}
+
+	ls, ok := v.([]interface{})
+	if !ok || len(ls) == 0 || ls[0] == nil {
+		return settings, nil
+	}
+
+	cfg := ls[0].(map[string]interface{})
+	settings.ignoreDaemonSets = cfg["ignore_daemonsets"].(bool)
+	settings.deleteEmptyDirData = cfg["delete_emptydir_data"].(bool)
+	settings.forceUnmanagedPods = cfg["force_unmanaged_pods"].(bool)
+
+	if gracePeriod := int64(cfg["grace_period_seconds"].(int)); gracePeriod >= 0 {
+		settings.gracePeriodSeconds = &gracePeriod
+	}
+
+	selector, err := parseLabelSelector(cfg["pod_selector_skip"].(string))
+	if err != nil {
+		return nil, err
+	}
+	settings.podSelectorSkip = selector
+
+	return settings, nil
+}
+
+// filterPod decides what to do with a pod on a node being drained, following
+// the rules of kubectl drain. It returns whether the pod should be evicted,
+// a warning to report if the pod is skipped or loses data, and an error if
+// the pod blocks the drain.
+func (s *drainSettings) filterPod(pod *KubernetesPod) (evict bool, warning string, err error) {
+	if pod.IsFinished() {
+		return false, "", nil
+	}
+
+	if _, ok := pod.Metadata.Annotations[kubernetesMirrorPodAnnotation]; ok {
+		return false, fmt.Sprintf("skipped mirror pod %s", pod), nil
+	}
+
+	if s.podSelectorSkip.matches(pod.Metadata.Labels) {
+		return false, fmt.Sprintf("skipped pod %s matching pod_selector_skip", pod), nil
+	}
+
+	controller := pod.controller()
+	if controller != nil && controller.Kind == "DaemonSet" {
+		if !s.ignoreDaemonSets {
+			return false, "", fmt.Errorf("pod %s is managed by DaemonSet %s (set ignore_daemonsets to skip it)", pod, controller.Name)
+		}
+		return false, fmt.Sprintf("skipped DaemonSet-managed pod %s", pod), nil
+	}
+
+	if controller == nil {
+		if !s.forceUnmanagedPods {
+			return false, "", fmt.Errorf("pod %s is not managed by a controller (set force_unmanaged_pods to evict it)", pod)
+		}
+		warning = fmt.Sprintf("evicted unmanaged pod %s, which will not be recreated", pod)
+	}
+
+	if pod.hasEmptyDir() {
+		if !s.deleteEmptyDirData {
+			return false, "", fmt.Errorf("pod %s uses emptyDir volumes (set delete_emptydir_data to evict it)", pod)
+		}
+		if warning == "" {
+			warning = fmt.Sprintf("deleted emptyDir data of pod %s", pod)
+		}
+	}
+
+	return true, warning, nil
+}
+
+// drainNodes cordons the named nodes, evicts the pods running on them and
+// waits for the evicted pods to be gone. Like kubectl drain, nothing is
+// evicted if any pod on the nodes blocks the drain.
+func (r *nodePoolRollout) drainNodes(nodeNames []string) error {
+	for _, nodeName := range nodeNames {
+		log.Printf("[DEBUG] Cordoning node %s", nodeName)
+		if err := r.kube.SetNodeUnschedulable(nodeName, true); err != nil {
+			return fmt.Errorf("Error cordoning node %s: %s", nodeName, err)
+		}
+	}
+
+	toEvict := []KubernetesPod{}
+	warnings := []string{}
+	errs := []string{}
+	for _, nodeName := range nodeNames {
+		pods, err := r.kube.ListNodePods(nodeName)
+		if err != nil {
+			return fmt.Errorf("Error listing pods on node %s: %s", nodeName, err)
+		}
+
+		for i := range pods {
+			evict, warning, err := r.drain.filterPod(&pods[i])
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			if warning != "" {
+				warnings = append(warnings, warning)
+			}
+			if evict {
+				toEvict = append(toEvict, pods[i])
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Cannot drain nodes %v:\n  %s", nodeNames, strings.Join(errs, "\n  "))
+	}
+
+	for _, warning := range warnings {
+		log.Printf("[WARN] %s", warning)
+	}
+	r.warnings = append(r.warnings, warnings...)
+
+	for i := range toEvict {
+		if err := r.evictPod(&toEvict[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range toEvict {
+		if err := r.awaitPodDeleted(&toEvict[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isDrained reports whether the node is cordoned and none of its pods would be
+// evicted by a drain. A node cordoned by a rollout that was interrupted before
+// its pods were gone still needs draining. Pods that block the drain count as
+// left, so that draining the node reports them.
+func (r *nodePoolRollout) isDrained(node *KubernetesNode) (bool, error) {
+	if !node.Spec.Unschedulable {
+		return false, nil
+	}
+
+	pods, err := r.kube.ListNodePods(node.Metadata.Name)
+	if err != nil {
+		return false, fmt.Errorf("Error listing pods on node %s: %s", node.Metadata.Name, err)
+	}
+	for i := range pods {
+		evict, _, err := r.drain.filterPod(&pods[i])
+		if evict || err != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// evictPod evicts the pod, retrying for as long as a PodDisruptionBudget
+// blocks the eviction.
+func (r *nodePoolRollout) evictPod(pod *KubernetesPod) error {
+	log.Printf("[DEBUG] Evicting pod %s from node %s", pod, pod.Spec.NodeName)
+	return resource.Retry(r.timeout(), func() *resource.RetryError {
+		err := r.kube.EvictPod(pod, r.drain.gracePeriodSeconds)
+		if err == nil {
+			r.metrics.podsEvicted++
+			r.evicted = append(r.evicted, *pod)
+			return nil
+		}
+		if isKubernetesApiErrorWithCode(err, 404) {
+			return nil
+		}
+		if isKubernetesApiErrorWithCode(err, 429) {
+			r.metrics.evictionRetries++
+			log.Printf("[DEBUG] Eviction of pod %s is blocked by a disruption budget, retrying", pod)
+			return resource.RetryableError(fmt.Errorf("Eviction of pod %s blocked: %s", pod, err))
+		}
+		return resource.NonRetryableError(fmt.Errorf("Error evicting pod %s: %s", pod, err))
+	})
+}
+
+// awaitPodDeleted waits until the pod is gone from the API server, or has
+// been replaced by a new pod with the same name.
+func (r *nodePoolRollout) awaitPodDeleted(pod *KubernetesPod) error {
+	return resource.Retry(r.timeout(), func() *resource.RetryError {
+		current, err := r.kube.GetPod(pod.Metadata.Namespace, pod.Metadata.Name)
+		if isKubernetesApiErrorWithCode(err, 404) {
+			return nil
+		}
+		if err != nil {
+			return resource.NonRetryableError(err)
+		}
+		if current.Metadata.UID != pod.Metadata.UID {
+			return nil
+		}
+		return resource.RetryableError(fmt.Errorf("pod %s is still terminating", pod))
+	})
+}
+
+// labelSelector is a parsed equality-based Kubernetes label selector, a list
+// of requirements that must all hold.
+type labelSelector []labelRequirement
+
+type labelRequirement struct {
+	key      string
+	operator string
+	value    string
+}
+
+var labelSelectorRequirementRegexp = regexp.MustCompile(`^(!?)\s*([A-Za-z0-9./_-]+)\s*(?:(==|=|!=)\s*([A-Za-z0-9._-]*))?$`)
+
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var parsed labelSelector
+	if strings.TrimSpace(selector) == "" {
+		return parsed, nil
+	}
+
+	for _, raw := range strings.Split(selector, ",") {
+		matches := labelSelectorRequirementRegexp.FindStringSubmatch(strings.TrimSpace(raw))
+		if matches == nil {
+			return nil, fmt.Errorf("invalid label selector requirement %q", raw)
+		}
+
+		req := labelRequirement{key: matches[2], value: matches[4]}
+		switch {
+		case matches[1] == "!" && matches[3] != "":
+			return nil, fmt.Errorf("invalid label selector requirement %q", raw)
+		case matches[1] == "!":
+			req.operator = "!"
+		case matches[3] == "":
+			req.operator = "exists"
+		case matches[3] == "!=":
+			req.operator = "!="
+		default:
+			req.operator = "="
+		}
+		parsed = append(parsed, req)
+	}
+
+	return parsed, nil
+}
+
+// matches reports whether the labels satisfy the selector. An empty selector
+// matches nothing.
+func (s labelSelector) matches(labels map[string]string) bool {
+	if len(s) == 0 {
+		return false
+	}
+
+	for _, req := range s {
+		value, ok := labels[req.key]
+		switch req.operator {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func validateLabelSelector(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := parseLabelSelector(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q: %s", k, err))
+	}
+	return
+}
@@ -0,0 +1,251 @@
+package rollgcp
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+// nodePoolDryRun reports whether updates of the node pool should only be
+// planned, either for the whole provider or for this resource.
+func nodePoolDryRun(d *schema.ResourceData, config *Config) bool {
+	return config.DryRun || d.Get("rollout.0.dry_run").(bool)
+}
+
+// rolloutPlan collects the steps of a dry run.
+type rolloutPlan struct {
+	steps []string
+	// evictions holds the pods each drain of a live node batch would evict,
+	// to weigh against the disruption budgets.
+	evictions [][]KubernetesPod
+}
+
+func (p *rolloutPlan) add(format string, a ...interface{}) {
+	step := fmt.Sprintf(format, a...)
+	log.Printf("[INFO] Dry run: %s", step)
+	p.steps = append(p.steps, step)
+}
+
+// plan works out the steps run would take to replace the live node pool with
+// desired, from the live state of the cluster, without changing anything.
+func (r *nodePoolRollout) plan(desired *containerBeta.NodePool) ([]string, error) {
+	p := &rolloutPlan{}
+	name := desired.Name
+	tmpName := r.temporaryName()
+	size := desired.InitialNodeCount
+
+	p.add("Roll NodePool %s through NodePool %s to %d nodes per zone of machine type %s", name, tmpName, size, desired.Config.MachineType)
+
+	if err := r.checkPinnedWorkloads(name); err != nil {
+		p.add("Stop before changing anything: %s", err)
+		return p.steps, nil
+	}
+	if r.relabelTemporaryNodes != "" {
+		p.add("Label the nodes of NodePool %s with %s=%s for the workloads pinned to NodePool %s", tmpName, gkeNodePoolLabel, r.relabelTemporaryNodes, name)
+	}
+
+	tmp := *desired
+	tmp.Name = tmpName
+	tmp.Config = r.temporaryOverrides.apply(desired.Config)
+	if err := r.checkReservationHeadroom(name, &tmp, size); err != nil {
+		p.add("Stop before changing anything: %s", err)
+		return p.steps, nil
+	}
+
+	fromZones, err := r.zoneCount(name)
+	if err != nil {
+		return nil, err
+	}
+	toZones := int64(len(desired.Locations))
+	if toZones == 0 {
+		toZones = fromZones
+	}
+
+	fromNodes, err := r.listNodePoolNodes(name)
+	if err != nil {
+		return nil, err
+	}
+	fromNodes = interleaveZones(fromNodes)
+	queue := []string{}
+	for i := range fromNodes {
+		drained, err := r.isDrained(&fromNodes[i])
+		if err != nil {
+			return nil, err
+		}
+		if !drained {
+			queue = append(queue, fromNodes[i].Metadata.Name)
+		}
+	}
+
+	start := int64(-1)
+	if r.canary != nil {
+		start = min64(r.canary.nodes, size)
+		p.add("Create NodePool %s with %d nodes per zone (%d nodes) as a canary", tmpName, start, start*toZones)
+
+		drainCount := int(math.Ceil(float64(len(fromNodes)*r.canary.drainPercent) / 100))
+		if drainCount > len(queue) {
+			drainCount = len(queue)
+		}
+		if err := r.planDrain(p, name, queue[:drainCount], true); err != nil {
+			return nil, err
+		}
+		queue = queue[drainCount:]
+		p.add("Soak the canary for %s; if it fails, uncordon the drained nodes and delete NodePool %s", r.canary.soakDuration, tmpName)
+	}
+
+	if err := r.planMigrate(p, name, tmpName, queue, true, start, size, fromZones, toZones); err != nil {
+		return nil, err
+	}
+	if len(r.fallbackZones) > 0 {
+		p.add("If NodePool %s hits a stockout, retry it in zones of %v", tmpName, r.fallbackZones)
+	}
+	p.add("Delete NodePool %s", name)
+
+	// The temporary nodes don't exist yet, so the way back can only be
+	// planned by count. It evicts the same pods as the way out.
+	tmpNodes := []string{}
+	for i := int64(0); i < size*toZones; i++ {
+		tmpNodes = append(tmpNodes, fmt.Sprintf("%s node %d", tmpName, i+1))
+	}
+	if err := r.planMigrate(p, tmpName, name, tmpNodes, false, -1, size, toZones, toZones); err != nil {
+		return nil, err
+	}
+	p.add("Delete NodePool %s", tmpName)
+
+	if err := r.planDisruptionBudgets(p); err != nil {
+		return nil, err
+	}
+
+	return p.steps, nil
+}
+
+// planMigrate mirrors migrate. The nodes of from are drained in the order
+// given; live says whether they exist yet and their pods can be listed.
+func (r *nodePoolRollout) planMigrate(p *rolloutPlan, from, to string, nodes []string, live bool, start, size, fromZones, toZones int64) error {
+	next := func(count int64) []string {
+		if count > int64(len(nodes)) {
+			count = int64(len(nodes))
+		}
+		batch := nodes[:count]
+		nodes = nodes[count:]
+		return batch
+	}
+
+	current := start
+	created := start >= 0
+	if !created {
+		current = 0
+	}
+	for !created || current < size {
+		step, early := r.settings.nextStep(current, size)
+
+		if err := r.planDrain(p, from, next(early*fromZones), live); err != nil {
+			return err
+		}
+
+		current += step
+		if !created {
+			p.add("Create NodePool %s with %d nodes per zone (%d nodes)", to, current, current*toZones)
+			created = true
+		} else {
+			p.add("Resize NodePool %s to %d nodes per zone (%d nodes)", to, current, current*toZones)
+		}
+		p.add("Wait for %d nodes of NodePool %s to be Ready", current*toZones, to)
+
+		if err := r.planDrain(p, from, next((step-early)*fromZones), live); err != nil {
+			return err
+		}
+	}
+
+	return r.planDrain(p, from, nodes, live)
+}
+
+// planDrain reports what draining the batch of nodes would do to the pods on
+// them.
+func (r *nodePoolRollout) planDrain(p *rolloutPlan, pool string, batch []string, live bool) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	p.add("Cordon and drain %d nodes of NodePool %s: %s", len(batch), pool, strings.Join(batch, ", "))
+	if !live {
+		return nil
+	}
+
+	evicted := []KubernetesPod{}
+	for _, nodeName := range batch {
+		pods, err := r.kube.ListNodePods(nodeName)
+		if err != nil {
+			return fmt.Errorf("Error listing pods on node %s: %s", nodeName, err)
+		}
+
+		evict := []string{}
+		for i := range pods {
+			ok, warning, err := r.drain.filterPod(&pods[i])
+			if err != nil {
+				p.add("  Node %s: drain would fail: %s", nodeName, err)
+				continue
+			}
+			if warning != "" {
+				p.add("  Node %s: %s", nodeName, warning)
+			}
+			if ok {
+				evict = append(evict, pods[i].String())
+				evicted = append(evicted, pods[i])
+			}
+		}
+		if len(evict) == 0 {
+			p.add("  Node %s: no pods to evict", nodeName)
+		} else {
+			p.add("  Node %s: evict %d pods: %s", nodeName, len(evict), strings.Join(evict, ", "))
+		}
+	}
+
+	p.evictions = append(p.evictions, evicted)
+	return nil
+}
+
+// planDisruptionBudgets reports, for every PodDisruptionBudget covering pods
+// the rollout would evict, how much headroom it has now against the largest
+// batch of evictions.
+func (r *nodePoolRollout) planDisruptionBudgets(p *rolloutPlan) error {
+	budgets, err := r.kube.ListPodDisruptionBudgets()
+	if err != nil {
+		return fmt.Errorf("Error listing PodDisruptionBudgets: %s", err)
+	}
+	sort.Slice(budgets, func(i, j int) bool {
+		return budgets[i].String() < budgets[j].String()
+	})
+
+	for i := range budgets {
+		budget := &budgets[i]
+		var total, largest int64
+		for _, batch := range p.evictions {
+			var n int64
+			for j := range batch {
+				if budget.covers(&batch[j]) {
+					n++
+				}
+			}
+			total += n
+			if n > largest {
+				largest = n
+			}
+		}
+		if total == 0 {
+			continue
+		}
+
+		headroom := fmt.Sprintf("PodDisruptionBudget %s allows %d disruptions (%d of %d desired pods healthy); the rollout evicts %d of its pods, at most %d in one drain", budget, budget.Status.DisruptionsAllowed, budget.Status.CurrentHealthy, budget.Status.DesiredHealthy, total, largest)
+		if largest > budget.Status.DisruptionsAllowed {
+			headroom += ", so evictions will wait for replacement pods to become healthy"
+		}
+		p.add("%s", headroom)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package rollgcp
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+var schemaNodePoolTemporaryPoolFallbackZones = &schema.Schema{
+	Type:        schema.TypeList,
+	Optional:    true,
+	Elem:        &schema.Schema{Type: schema.TypeString},
+	Description: `Zones to retry the temporary node pool in, in order of preference, when it cannot be created in the node pool's locations because of a zone stockout. Each attempt uses as many zones as the node pool spans. The final node pool is always created in its declared locations.`,
+}
+
+// The markers GKE puts in the operation error or node pool condition when a
+// zone has run out of the requested resources.
+var stockoutMarkers = []string{"GCE_STOCKOUT", "ZONE_RESOURCE_POOL_EXHAUSTED", "stockout"}
+
+func isStockoutError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, marker := range stockoutMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func expandFallbackZones(v interface{}) []string {
+	zones := []string{}
+	for _, zone := range v.([]interface{}) {
+		zones = append(zones, zone.(string))
+	}
+	return zones
+}
+
+// fallbackZoneSets returns the consecutive runs of count zones of the fallback
+// list, skipping the run that matches the zones that already failed.
+func fallbackZoneSets(fallback, failed []string, count int) [][]string {
+	failedZones := map[string]bool{}
+	for _, zone := range failed {
+		failedZones[zone] = true
+	}
+
+	sets := [][]string{}
+	for i := 0; i+count <= len(fallback); i++ {
+		set := fallback[i : i+count]
+		same := len(set) == len(failed)
+		for _, zone := range set {
+			same = same && failedZones[zone]
+		}
+		if !same {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// createTemporaryNodePoolInFallbackZones retries the creation of the temporary
+// node pool in the fallback zones after it failed with cause, a stockout. The
+// failed pool is deleted before each new attempt.
+func (r *nodePoolRollout) createTemporaryNodePoolInFallbackZones(nodePool *containerBeta.NodePool, cause error) error {
+	failed := nodePool.Locations
+	if current, err := r.deleteFailedNodePool(nodePool.Name); err != nil {
+		return fmt.Errorf("%s; additionally, %s", cause, err)
+	} else if current != nil && len(current.Locations) > 0 {
+		failed = current.Locations
+	}
+
+	count := len(failed)
+	if count == 0 {
+		count = 1
+	}
+	if len(r.fallbackZones) < count {
+		return fmt.Errorf("%s; temporary_pool_fallback_zones lists %d zones but NodePool %s needs %d", cause, len(r.fallbackZones), nodePool.Name, count)
+	}
+
+	for _, zones := range fallbackZoneSets(r.fallbackZones, failed, count) {
+		log.Printf("[WARN] GKE NodePool %s hit a stockout in %v, retrying in %v", nodePool.Name, failed, zones)
+
+		spec := *nodePool
+		spec.Locations = zones
+		err := r.createNodePoolOnce(&spec)
+		if err == nil {
+			warning := fmt.Sprintf("NodePool %s was created in the fallback zones %v after a stockout in %v", nodePool.Name, zones, failed)
+			log.Printf("[WARN] %s", warning)
+			r.warnings = append(r.warnings, warning)
+			return nil
+		}
+		if !isStockoutError(err) {
+			return err
+		}
+
+		cause = err
+		failed = zones
+		if _, err := r.deleteFailedNodePool(nodePool.Name); err != nil {
+			return fmt.Errorf("%s; additionally, %s", cause, err)
+		}
+	}
+
+	return fmt.Errorf("%s; no zones of temporary_pool_fallback_zones had capacity for NodePool %s", cause, nodePool.Name)
+}
+
+// deleteFailedNodePool deletes what a failed create left behind of the named
+// node pool, if anything, and returns the pool as it was before the delete.
+func (r *nodePoolRollout) deleteFailedNodePool(name string) (*containerBeta.NodePool, error) {
+	nodePool, err := r.config.refreshNodePool(r.nodePoolInfo.fullyQualifiedName(name), r.nodePoolInfo.project, r.userAgent)
+	if isGoogleApiErrorWithCode(err, 404) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading failed NodePool %s failed: %s", name, err)
+	}
+
+	log.Printf("[INFO] Deleting failed GKE NodePool %s", name)
+	if err := containerNodePoolDelete(r.config, r.nodePoolInfo, name, r.userAgent, r.timeout()); err != nil {
+		return nil, fmt.Errorf("deleting failed NodePool %s failed: %s", name, err)
+	}
+	return nodePool, nil
+}
@@ -0,0 +1,332 @@
+package rollgcp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	computeBeta "google.golang.org/api/compute/v0.beta"
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+// The ways a node pool can be rolled.
+const (
+	// rolloutStrategyTemporaryPool moves the workloads through a temporary
+	// node pool, see nodePoolRollout.
+	rolloutStrategyTemporaryPool = "temporary_pool"
+	// rolloutStrategyGKESurge lets GKE upgrade the nodes in place, governed
+	// by upgrade_settings.
+	rolloutStrategyGKESurge = "gke_surge"
+)
+
+var schemaNodePoolRolloutStrategy = &schema.Schema{
+	Type:         schema.TypeString,
+	Optional:     true,
+	Default:      rolloutStrategyTemporaryPool,
+	ValidateFunc: validation.StringInSlice([]string{rolloutStrategyTemporaryPool, rolloutStrategyGKESurge}, false),
+	Description:  `How the node pool is rolled. "temporary_pool" moves the workloads through a temporary node pool and supports every change. "gke_surge" uses GKE's own surge upgrade, governed by upgrade_settings, and only supports changes GKE can apply in place: version, node_locations, upgrade_settings, node_count and the image_type, workload_metadata_config, kubelet_config and linux_node_config of node_config.`,
+}
+
+// The node pool attributes GKE can change in place, and the node_config
+// attributes among them.
+var (
+	gkeSurgeUpdatableFields = map[string]bool{
+		"version":          true,
+		"node_locations":   true,
+		"upgrade_settings": true,
+		"node_count":       true,
+	}
+	gkeSurgeUpdatableNodeConfigFields = map[string]bool{
+		"image_type":               true,
+		"workload_metadata_config": true,
+		"kubelet_config":           true,
+		"linux_node_config":        true,
+	}
+)
+
+// validateRolloutStrategy fails the plan if the gke_surge strategy is asked to
+// apply a change GKE cannot make in place.
+func validateRolloutStrategy(_ context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+	if diff.Id() == "" || diff.Get("rollout_strategy").(string) != rolloutStrategyGKESurge {
+		return nil
+	}
+
+	unsupported := []string{}
+	for k, s := range schemaNodePool {
+		if s.ForceNew || gkeSurgeUpdatableFields[k] {
+			continue
+		}
+		if k != "node_config" {
+			if diff.HasChange(k) {
+				unsupported = append(unsupported, k)
+			}
+			continue
+		}
+		for nk := range s.Elem.(*schema.Resource).Schema {
+			if !gkeSurgeUpdatableNodeConfigFields[nk] && diff.HasChange("node_config.0."+nk) {
+				unsupported = append(unsupported, "node_config.0."+nk)
+			}
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+
+	sort.Strings(unsupported)
+	return fmt.Errorf("rollout_strategy %q cannot change %s; use rollout_strategy %q for these changes", rolloutStrategyGKESurge, strings.Join(unsupported, ", "), rolloutStrategyTemporaryPool)
+}
+
+// nodePoolSurgeUpdate applies the changes to the node pool with GKE's surge
+// upgrade, tracking the progress of the nodes while the operation runs. It
+// returns warnings about the nodes GKE left behind, even if the upgrade
+// failed. In a dry run, it returns the steps it would take instead.
+func nodePoolSurgeUpdate(d *schema.ResourceData, meta interface{}, nodePoolInfo *NodePoolInformation, prefix string, timeout time.Duration) (warnings, steps []string, err error) {
+	config := meta.(*Config)
+	userAgent, err := generateUserAgentString(d, config.userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := d.Get(prefix + "name").(string)
+	deadline := time.Now().Add(timeout)
+	dryRun := nodePoolDryRun(d, config)
+	plan := &rolloutPlan{}
+
+	if d.HasChanges(prefix+"version", prefix+"node_locations", prefix+"upgrade_settings", prefix+"node_config") {
+		nodeConfig := expandNodeConfig(d.Get(prefix + "node_config"))
+		req := &containerBeta.UpdateNodePoolRequest{
+			NodeVersion:            d.Get(prefix + "version").(string),
+			ImageType:              nodeConfig.ImageType,
+			UpgradeSettings:        expandUpgradeSettings(d, prefix),
+			WorkloadMetadataConfig: nodeConfig.WorkloadMetadataConfig,
+			KubeletConfig:          nodeConfig.KubeletConfig,
+			LinuxNodeConfig:        nodeConfig.LinuxNodeConfig,
+		}
+		if d.HasChange(prefix + "node_locations") {
+			req.Locations = convertStringSet(d.Get(prefix + "node_locations").(*schema.Set))
+		}
+
+		if dryRun {
+			plan.add("Upgrade NodePool %s in place with GKE to version %s and image type %s in zones %v, with %s", name, req.NodeVersion, req.ImageType, d.Get(prefix+"node_locations").(*schema.Set).List(), describeUpgradeSettings(req.UpgradeSettings))
+		} else {
+			log.Printf("[INFO] GKE NodePool %s is being upgraded in place by GKE", name)
+			warnings, err = containerNodePoolSurgeUpgrade(config, nodePoolInfo, name, req, userAgent, time.Until(deadline))
+			if err != nil {
+				return warnings, nil, err
+			}
+		}
+	}
+
+	if d.HasChange(prefix + "node_count") {
+		nodeCount := int64(d.Get(prefix + "node_count").(int))
+		if dryRun {
+			plan.add("Resize NodePool %s to %d nodes per zone", name, nodeCount)
+		} else {
+			log.Printf("[INFO] GKE NodePool %s is being resized to %d nodes per zone", name, nodeCount)
+			if err := containerNodePoolSetSize(config, nodePoolInfo, name, nodeCount, userAgent, time.Until(deadline)); err != nil {
+				return warnings, nil, err
+			}
+		}
+	}
+
+	if !dryRun {
+		log.Printf("[INFO] GKE NodePool %s has been updated", name)
+	}
+
+	return warnings, plan.steps, nil
+}
+
+func describeUpgradeSettings(s *containerBeta.UpgradeSettings) string {
+	if s == nil {
+		return "GKE's default upgrade settings"
+	}
+	return fmt.Sprintf("max_surge %d and max_unavailable %d", s.MaxSurge, s.MaxUnavailable)
+}
+
+// containerNodePoolSurgeUpgrade issues the update call for the named node pool
+// and waits for the resulting operation, tracking the progress of each node
+// from the pool's instance group managers in the meantime. It returns a
+// warning for every node not running the pool's current instance template once
+// the operation has ended.
+func containerNodePoolSurgeUpgrade(config *Config, nodePoolInfo *NodePoolInformation, name string, req *containerBeta.UpdateNodePoolRequest, userAgent string, timeout time.Duration) ([]string, error) {
+	mutexKV.Lock(nodePoolInfo.lockKey())
+	defer mutexKV.Unlock(nodePoolInfo.lockKey())
+	defer config.invalidateNodePool(nodePoolInfo.fullyQualifiedName(name))
+
+	startTime := time.Now()
+
+	var operation *containerBeta.Operation
+	err := resource.Retry(timeout, func() *resource.RetryError {
+		var err error
+		clusterNodePoolsUpdateCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Update(nodePoolInfo.fullyQualifiedName(name), req)
+		if config.UserProjectOverride {
+			clusterNodePoolsUpdateCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
+		}
+		operation, err = clusterNodePoolsUpdateCall.Do()
+
+		if err != nil {
+			if isFailedPreconditionError(err) {
+				// We get failed precondition errors if the cluster is updating
+				// while we try to update the node pool.
+				return resource.RetryableError(err)
+			}
+			return resource.NonRetryableError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error updating NodePool: %s", err)
+	}
+	timeout -= time.Since(startTime)
+
+	progress := newSurgeUpgradeProgress(config, nodePoolInfo, name, userAgent)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(config.PollInterval):
+			}
+			progress.poll()
+		}
+	}()
+
+	err = containerOperationWait(config, operation, nodePoolInfo.project, nodePoolInfo.location, "updating GKE NodePool", userAgent, timeout)
+	close(done)
+	<-stopped
+
+	// Take stock of the nodes once the operation has ended.
+	progress.poll()
+	return progress.warnings(), err
+}
+
+// surgeNodeState is the state of a node during a surge upgrade.
+type surgeNodeState struct {
+	// action is the current action of the instance group manager on the
+	// node, NONE once it is left alone.
+	action   string
+	upgraded bool
+}
+
+// surgeUpgradeProgress tracks the nodes of a node pool GKE is upgrading. Each
+// change is logged, and the count of upgraded nodes is written to the metrics
+// textfile as it grows.
+type surgeUpgradeProgress struct {
+	config       *Config
+	nodePoolInfo *NodePoolInformation
+	name         string
+	userAgent    string
+
+	nodes   map[string]surgeNodeState
+	summary string
+}
+
+func newSurgeUpgradeProgress(config *Config, nodePoolInfo *NodePoolInformation, name, userAgent string) *surgeUpgradeProgress {
+	return &surgeUpgradeProgress{
+		config:       config,
+		nodePoolInfo: nodePoolInfo,
+		name:         name,
+		userAgent:    userAgent,
+		nodes:        map[string]surgeNodeState{},
+	}
+}
+
+// poll reads the instance group managers of the node pool and records the
+// state of each of its nodes. A node counts as upgraded once it runs the
+// manager's current instance template and no action is pending on it.
+func (p *surgeUpgradeProgress) poll() {
+	nodePool, err := p.config.refreshNodePool(p.nodePoolInfo.fullyQualifiedName(p.name), p.nodePoolInfo.project, p.userAgent)
+	if err != nil {
+		log.Printf("[DEBUG] Unable to read NodePool %s for upgrade progress: %s", p.name, err)
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, url := range nodePool.InstanceGroupUrls {
+		matches := instanceGroupManagerURL.FindStringSubmatch(url)
+		if len(matches) < 4 {
+			continue
+		}
+		igm, err := p.config.NewComputeBetaClient(p.userAgent).InstanceGroupManagers.Get(matches[1], matches[2], matches[3]).Do()
+		if err != nil {
+			log.Printf("[DEBUG] Unable to read instance group manager %s for upgrade progress: %s", url, err)
+			return
+		}
+
+		err = p.config.NewComputeBetaClient(p.userAgent).InstanceGroupManagers.ListManagedInstances(matches[1], matches[2], matches[3]).Pages(p.config.context, func(page *computeBeta.InstanceGroupManagersListManagedInstancesResponse) error {
+			for _, instance := range page.ManagedInstances {
+				node := instance.Instance[strings.LastIndex(instance.Instance, "/")+1:]
+				state := surgeNodeState{
+					action:   instance.CurrentAction,
+					upgraded: instance.CurrentAction == "NONE" && instance.Version != nil && instance.Version.InstanceTemplate == igm.InstanceTemplate,
+				}
+				if p.nodes[node].action != state.action {
+					log.Printf("[DEBUG] Node %s of NodePool %s: %s", node, p.name, state.action)
+				}
+				p.nodes[node] = state
+				seen[node] = true
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[DEBUG] Unable to list instances of %s for upgrade progress: %s", url, err)
+			return
+		}
+	}
+
+	// Nodes GKE deleted, such as those replaced by a surge node, are gone
+	// for good.
+	for node := range p.nodes {
+		if !seen[node] {
+			delete(p.nodes, node)
+		}
+	}
+
+	upgraded := 0
+	for _, state := range p.nodes {
+		if state.upgraded {
+			upgraded++
+		}
+	}
+	if s := fmt.Sprintf("%d of %d nodes upgraded", upgraded, len(p.nodes)); s != p.summary {
+		log.Printf("[INFO] GKE NodePool %s: %s", p.name, s)
+		p.summary = s
+		p.config.metrics.recordSurgeProgress(poolMetricsKey{
+			project: p.nodePoolInfo.project,
+			cluster: p.nodePoolInfo.cluster,
+			pool:    p.name,
+		}, upgraded, len(p.nodes))
+		p.config.metrics.write()
+	}
+}
+
+// warnings describes the nodes that were not upgraded.
+func (p *surgeUpgradeProgress) warnings() []string {
+	nodes := make([]string, 0, len(p.nodes))
+	for node := range p.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var warnings []string
+	for _, node := range nodes {
+		state := p.nodes[node]
+		switch {
+		case state.upgraded:
+		case state.action != "NONE":
+			warnings = append(warnings, fmt.Sprintf("node %s is still being acted on by GKE (%s)", node, state.action))
+		default:
+			warnings = append(warnings, fmt.Sprintf("node %s does not run the node pool's current instance template", node))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,103 @@
+package rollgcp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	computeBeta "google.golang.org/api/compute/v0.beta"
+)
+
+// nodePoolInstanceGroupManagers reads the instance group managers behind a
+// node pool's instance group URLs, keyed by URL, with one aggregated list
+// call per project rather than one call per zone. URLs whose instance group
+// manager no longer exists are left out.
+func nodePoolInstanceGroupManagers(config *Config, urls []string, userAgent string) (map[string]*computeBeta.InstanceGroupManager, error) {
+	// project -> zone/name -> URL
+	wanted := map[string]map[string]string{}
+	for _, url := range urls {
+		matches := instanceGroupManagerURL.FindStringSubmatch(url)
+		if len(matches) < 4 {
+			return nil, fmt.Errorf("Error reading instance group manage URL '%q'", url)
+		}
+		if wanted[matches[1]] == nil {
+			wanted[matches[1]] = map[string]string{}
+		}
+		wanted[matches[1]][matches[2]+"/"+matches[3]] = url
+	}
+
+	igms := map[string]*computeBeta.InstanceGroupManager{}
+	for project, byZoneName := range wanted {
+		names := map[string]bool{}
+		for zoneName := range byZoneName {
+			names[zoneName[strings.Index(zoneName, "/")+1:]] = true
+		}
+		filters := []string{}
+		for name := range names {
+			filters = append(filters, fmt.Sprintf("(name = %q)", name))
+		}
+		sort.Strings(filters)
+
+		err := config.NewComputeBetaClient(userAgent).InstanceGroupManagers.AggregatedList(project).Filter(strings.Join(filters, " OR ")).Pages(config.context, func(page *computeBeta.InstanceGroupManagerAggregatedList) error {
+			for _, scoped := range page.Items {
+				for _, igm := range scoped.InstanceGroupManagers {
+					zone := igm.Zone[strings.LastIndex(igm.Zone, "/")+1:]
+					if url, ok := byZoneName[zone+"/"+igm.Name]; ok {
+						igms[url] = igm
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error listing instance group managers of project %s: %s", project, err)
+		}
+	}
+
+	return igms, nil
+}
+
+// flattenZonalNodeCounts returns the target size of each instance group
+// manager by zone.
+func flattenZonalNodeCounts(igms map[string]*computeBeta.InstanceGroupManager) map[string]interface{} {
+	counts := map[string]interface{}{}
+	for _, igm := range igms {
+		zone := igm.Zone[strings.LastIndex(igm.Zone, "/")+1:]
+		counts[zone] = int(igm.TargetSize)
+	}
+	return counts
+}
+
+// nodePoolZoneDivergence warns if the zones of the node pool were not all
+// sized alike when it was last read, which node_count, being their average,
+// hides.
+func nodePoolZoneDivergence(name string, d *schema.ResourceData) diag.Diagnostics {
+	counts := d.Get("zonal_node_counts").(map[string]interface{})
+	zones := make([]string, 0, len(counts))
+	for zone := range counts {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	diverged := false
+	parts := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		if counts[zone] != counts[zones[0]] {
+			diverged = true
+		}
+		parts = append(parts, fmt.Sprintf("%s: %v", zone, counts[zone]))
+	}
+	if !diverged {
+		return nil
+	}
+
+	return diag.Diagnostics{
+		{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("The zones of NodePool %s have different numbers of nodes", name),
+			Detail:   fmt.Sprintf("node_count is their average, %d. Nodes per zone: %s. A resize may have failed in some zones, or a zone may be out of capacity.", d.Get("node_count").(int), strings.Join(parts, ", ")),
+		},
+	}
+}
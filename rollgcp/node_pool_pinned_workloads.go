@@ -0,0 +1,104 @@
+package rollgcp
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+const (
+	// Fail the rollout if any workload is pinned to the node pool.
+	pinnedWorkloadPolicyFail = "fail"
+	// Label the temporary pool's nodes with the original pool's name so
+	// pinned workloads can be scheduled on them.
+	pinnedWorkloadPolicyRelabel = "relabel"
+)
+
+var schemaNodePoolPinnedWorkloadPolicy = &schema.Schema{
+	Type:         schema.TypeString,
+	Optional:     true,
+	Default:      pinnedWorkloadPolicyFail,
+	ValidateFunc: validation.StringInSlice([]string{pinnedWorkloadPolicyFail, pinnedWorkloadPolicyRelabel}, false),
+	Description:  `What to do when workloads select the node pool by name through a nodeSelector or required node affinity on cloud.google.com/gke-nodepool, and so could not be scheduled on the temporary node pool. "fail" stops the rollout before anything is drained and lists the workloads. "relabel" sets the label on the temporary pool's nodes to the node pool's name.`,
+}
+
+// findPinnedWorkloads returns the workloads, and bare pods, that can only be
+// scheduled on nodes of the named node pool.
+func (r *nodePoolRollout) findPinnedWorkloads(pool string) ([]string, error) {
+	pinned := []string{}
+
+	for kind := range kubernetesWorkloadKinds {
+		workloads, err := r.kube.ListWorkloads(kind)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing %ss: %s", kind, err)
+		}
+		for i := range workloads {
+			if workloads[i].PodSpec.requiresNodeLabel(gkeNodePoolLabel, pool) {
+				pinned = append(pinned, workloads[i].String())
+			}
+		}
+	}
+
+	pods, err := r.kube.ListPods("")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing pods: %s", err)
+	}
+	for i := range pods {
+		pod := &pods[i]
+		if pod.controller() == nil && !pod.IsFinished() && pod.Spec.requiresNodeLabel(gkeNodePoolLabel, pool) {
+			pinned = append(pinned, "Pod "+pod.String())
+		}
+	}
+
+	sort.Strings(pinned)
+	return pinned, nil
+}
+
+// checkPinnedWorkloads applies the pinned workload policy before the first
+// node of the named pool is drained.
+func (r *nodePoolRollout) checkPinnedWorkloads(pool string) error {
+	pinned, err := r.findPinnedWorkloads(pool)
+	if err != nil {
+		return err
+	}
+	if len(pinned) == 0 {
+		return nil
+	}
+
+	switch r.pinnedWorkloadPolicy {
+	case pinnedWorkloadPolicyRelabel:
+		log.Printf("[INFO] Workloads %v are pinned to NodePool %s; the nodes of NodePool %s will be labeled %s=%s", pinned, pool, temporaryNodePoolName(pool), gkeNodePoolLabel, pool)
+		r.relabelTemporaryNodes = pool
+		return nil
+	default:
+		return fmt.Errorf("The following workloads select NodePool %s through %s and could not be scheduled on NodePool %s. Remove the selector or set pinned_workload_policy to %q:\n  %s",
+			pool, gkeNodePoolLabel, temporaryNodePoolName(pool), pinnedWorkloadPolicyRelabel, strings.Join(pinned, "\n  "))
+	}
+}
+
+// labelTemporaryNodes gives the temporary pool's nodes the original pool's
+// name label, if the pinned workload policy asked for it.
+func (r *nodePoolRollout) labelTemporaryNodes(pool string) error {
+	if pool != r.temporaryName() || r.relabelTemporaryNodes == "" {
+		return nil
+	}
+
+	nodes, err := r.listNodePoolNodes(pool)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node.Metadata.Labels[gkeNodePoolLabel] == r.relabelTemporaryNodes {
+			continue
+		}
+		log.Printf("[DEBUG] Labeling node %s %s=%s", node.Metadata.Name, gkeNodePoolLabel, r.relabelTemporaryNodes)
+		if err := r.kube.SetNodeLabel(node.Metadata.Name, gkeNodePoolLabel, r.relabelTemporaryNodes); err != nil {
+			return fmt.Errorf("Error labeling node %s: %s", node.Metadata.Name, err)
+		}
+	}
+	return nil
+}
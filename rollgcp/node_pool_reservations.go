@@ -0,0 +1,69 @@
+package rollgcp
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+// The reservation affinity key that selects Compute Engine reservations by
+// name.
+const reservationNameAffinityKey = "compute.googleapis.com/reservation-name"
+
+// checkReservationHeadroom makes sure the specific reservations the temporary
+// node pool must consume from have room for it. The original pool keeps its
+// share of the reservations until it is deleted, so a reservation sized only
+// for the live pool leaves nothing for the temporary pool.
+func (r *nodePoolRollout) checkReservationHeadroom(name string, tmp *containerBeta.NodePool, size int64) error {
+	affinity := tmp.Config.ReservationAffinity
+	if affinity == nil || affinity.ConsumeReservationType != "SPECIFIC_RESERVATION" || affinity.Key != reservationNameAffinityKey {
+		return nil
+	}
+
+	zones := tmp.Locations
+	if len(zones) == 0 {
+		live, err := r.getNodePool(name)
+		if err != nil {
+			return err
+		}
+		zones = live.Locations
+	}
+
+	shortfalls := []string{}
+	for _, zone := range zones {
+		var free int64
+		for _, value := range affinity.Values {
+			project, reservationName := r.nodePoolInfo.project, value
+			if parts := strings.Split(value, "/"); len(parts) == 4 && parts[0] == "projects" && parts[2] == "reservations" {
+				project, reservationName = parts[1], parts[3]
+			}
+
+			reservation, err := r.config.NewComputeBetaClient(r.userAgent).Reservations.Get(project, zone, reservationName).Do()
+			if isGoogleApiErrorWithCode(err, 404) {
+				// Reservations are zonal; this one lives in another zone.
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("Error reading reservation %s in zone %s: %s", value, zone, err)
+			}
+			if reservation.SpecificReservation == nil {
+				continue
+			}
+			free += reservation.SpecificReservation.Count - reservation.SpecificReservation.InUseCount
+		}
+
+		log.Printf("[DEBUG] Reservations %v have %d free instances in zone %s", affinity.Values, free, zone)
+		if free < size {
+			shortfalls = append(shortfalls, fmt.Sprintf("zone %s has %d free instances, %d are needed", zone, free, size))
+		}
+	}
+
+	if len(shortfalls) > 0 {
+		return fmt.Errorf("The reservations %v do not have room for NodePool %s, which runs alongside NodePool %s during the rollout:\n  %s",
+			affinity.Values, temporaryNodePoolName(name), name, strings.Join(shortfalls, "\n  "))
+	}
+
+	return nil
+}
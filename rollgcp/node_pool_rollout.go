@@ -0,0 +1,654 @@
+package rollgcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+// The node label that marks the nodes of a temporary node pool, with the name
+// of the pool being replaced as its value. The cloud.google.com/gke-nodepool
+// label cannot be relied on for them, since it may be rewritten to the
+// original pool's name for pinned workloads.
+const temporaryNodePoolLabel = "rollgcp/temporary-node-pool"
+
+// GKE's limit on the length of node pool names.
+const maxNodePoolNameLength = 40
+
+// temporaryNodePoolName returns the name of the node pool workloads are parked
+// on while the named pool is replaced. Every pool gets its own, so that pools
+// of the same cluster can be rolled at the same time. Names over GKE's limit
+// are shortened, with a hash of the pool's name keeping them apart.
+func temporaryNodePoolName(pool string) string {
+	name := "temp-" + pool
+	if len(name) <= maxNodePoolNameLength {
+		return name
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(pool)))[:8]
+	return name[:maxNodePoolNameLength-len(sum)-1] + "-" + sum
+}
+
+// The name every temporary node pool had before each pool got its own. Such
+// pools may be left over from an interrupted rollout of an older version, and
+// lack the temporaryNodePoolLabel.
+const legacyTemporaryNodePoolName = "temp-node-pool"
+
+var schemaNodePoolRollout = &schema.Schema{
+	Type:        schema.TypeList,
+	Optional:    true,
+	MaxItems:    1,
+	Description: `Controls how fast workloads are moved between node pools when the node pool is rolled. If unset, the temporary and new node pools are created at full size and the old nodes are drained all at once.`,
+	Elem: &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"max_surge_nodes": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				ValidateFunc: validation.IntAtLeast(0),
+				Description:  `The number of nodes per zone the destination pool may grow by ahead of the nodes drained from the source pool.`,
+			},
+
+			"max_unavailable_nodes": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntAtLeast(0),
+				Description:  `The number of nodes per zone that may be drained from the source pool before the destination pool has grown to replace them.`,
+			},
+
+			"dry_run": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: `Report the steps a rollout would take, as a warning, instead of taking them.`,
+			},
+		},
+	},
+}
+
+type rolloutSettings struct {
+	// maxSurgeNodes and maxUnavailableNodes are per zone. A zero batch size
+	// means the whole pool is moved in one batch.
+	maxSurgeNodes       int64
+	maxUnavailableNodes int64
+}
+
+func expandRolloutSettings(v interface{}) *rolloutSettings {
+	settings := &rolloutSettings{}
+
+	ls, ok := v.([]interface{})
+	if !ok || len(ls) == 0 || ls[0] == nil {
+		return settings
+	}
+
+	cfg := ls[0].(map[string]interface{})
+	if v, ok := cfg["max_surge_nodes"]; ok {
+		settings.maxSurgeNodes = int64(v.(int))
+	}
+	if v, ok := cfg["max_unavailable_nodes"]; ok {
+		settings.maxUnavailableNodes = int64(v.(int))
+	}
+
+	return settings
+}
+
+// batch returns the number of surge and unavailable nodes per zone to use when
+// moving a pool of size nodes per zone.
+func (s *rolloutSettings) batch(size int64) (surge, unavailable int64) {
+	if s.maxSurgeNodes+s.maxUnavailableNodes == 0 {
+		return size, 0
+	}
+	return s.maxSurgeNodes, s.maxUnavailableNodes
+}
+
+// nextStep returns how many nodes per zone the destination pool grows by in
+// the next batch of a move to size nodes per zone, and how many of the
+// matching source nodes per zone are drained before it grows.
+func (s *rolloutSettings) nextStep(current, size int64) (step, early int64) {
+	surge, unavailable := s.batch(size)
+	step = min64(surge+unavailable, size-current)
+	return step, min64(unavailable, step)
+}
+
+func validateRolloutSettings(_ context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+	if _, ok := diff.GetOk("rollout"); !ok {
+		return nil
+	}
+	surge := diff.Get("rollout.0.max_surge_nodes").(int)
+	unavailable := diff.Get("rollout.0.max_unavailable_nodes").(int)
+	if surge+unavailable == 0 {
+		return fmt.Errorf("rollout: at least one of max_surge_nodes and max_unavailable_nodes must be greater than 0")
+	}
+	return nil
+}
+
+// nodePoolRollout replaces a node pool with one built from a new
+// configuration by moving workloads through a temporary pool.
+type nodePoolRollout struct {
+	config       *Config
+	nodePoolInfo *NodePoolInformation
+	// pool is the name of the node pool being rolled.
+	pool      string
+	userAgent string
+	settings  *rolloutSettings
+	canary    *canarySettings
+	drain     *drainSettings
+	// pinnedWorkloadPolicy is one of the pinnedWorkloadPolicy constants.
+	// relabelTemporaryNodes, if set, is the pool name to label the temporary
+	// pool's nodes with.
+	pinnedWorkloadPolicy  string
+	relabelTemporaryNodes string
+	temporaryOverrides    *temporaryPoolOverrides
+	fallbackZones         []string
+	kube                  *KubernetesClient
+	deadline              time.Time
+
+	// span traces the rollout as a whole, and phaseSpan the phase in
+	// progress. Both are nil unless tracing is on.
+	span      *traceSpan
+	phaseSpan *traceSpan
+
+	metrics *rolloutMetrics
+
+	// onPhase, if set, is called as the rollout enters each phase, so that
+	// its progress can be recorded.
+	onPhase func(phase string) error
+
+	// warnings collects problems worth reporting that did not stop the rollout.
+	warnings []string
+
+	// evicted lists the pods the rollout has evicted, in order.
+	evicted []KubernetesPod
+}
+
+func newNodePoolRollout(config *Config, nodePoolInfo *NodePoolInformation, pool, userAgent string, settings *rolloutSettings, timeout time.Duration) (*nodePoolRollout, error) {
+	kube, err := config.NewKubernetesClient(nodePoolInfo, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := newRolloutMetrics()
+	return &nodePoolRollout{
+		config:               config.withRetryCounters(metrics.retries),
+		nodePoolInfo:         nodePoolInfo,
+		pool:                 pool,
+		userAgent:            userAgent,
+		settings:             settings,
+		drain:                &drainSettings{ignoreDaemonSets: true},
+		pinnedWorkloadPolicy: pinnedWorkloadPolicyFail,
+		kube:                 kube,
+		deadline:             time.Now().Add(timeout),
+		metrics:              metrics,
+	}, nil
+}
+
+func (r *nodePoolRollout) timeout() time.Duration {
+	return time.Until(r.deadline)
+}
+
+func (r *nodePoolRollout) temporaryName() string {
+	return temporaryNodePoolName(r.pool)
+}
+
+// The phases of a rollout, in order. A rollout that was interrupted can be
+// resumed from the phase it was in.
+const (
+	rolloutPhaseMoveToTemporary = "move-to-temporary"
+	rolloutPhaseDeleteOriginal  = "delete-original"
+	rolloutPhaseMoveToNew       = "move-to-new"
+	rolloutPhaseDeleteTemporary = "delete-temporary"
+	rolloutPhaseDone            = "done"
+)
+
+// run replaces the live node pool named desired.Name with desired.
+//
+// 1. creates a temporary node pool and moves the workloads onto it
+// 2. deletes the original node pool
+// 3. creates the new node pool with the original name and moves the workloads back
+// 4. deletes the temporary node pool
+//
+// When a canary is configured, step 1 starts with a canary phase that aborts
+// the rollout before anything is deleted.
+func (r *nodePoolRollout) run(desired *containerBeta.NodePool) error {
+	return r.resume(desired, rolloutPhaseMoveToTemporary)
+}
+
+// resume runs the rollout from the given phase. The node pools are inspected
+// as they are found, so a phase that was interrupted part way through picks
+// up where it stopped.
+func (r *nodePoolRollout) resume(desired *containerBeta.NodePool, phase string) (err error) {
+	name := desired.Name
+	tmpName := r.temporaryName()
+	size := desired.InitialNodeCount
+
+	r.startTrace(phase)
+	r.metrics.begin()
+	defer func() {
+		r.endTrace(err)
+		r.config.metrics.recordRollout(r.metricsKey(), r.metrics, err)
+	}()
+
+	log.Printf("[INFO] GKE NodePool %s is being rolled through NodePool %s, starting at phase %s", name, tmpName, phase)
+
+	if err := r.checkPinnedWorkloads(name); err != nil {
+		return err
+	}
+
+	tmp := *desired
+	tmp.Name = tmpName
+	tmp.Config = r.temporaryOverrides.apply(desired.Config)
+	tmp.Config.Labels[temporaryNodePoolLabel] = name
+
+	switch phase {
+	case rolloutPhaseMoveToTemporary:
+		if err := r.enterPhase(rolloutPhaseMoveToTemporary); err != nil {
+			return err
+		}
+
+		start, exists, err := r.nodePoolSize(tmpName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			start = -1
+			if err := r.checkReservationHeadroom(name, &tmp, size); err != nil {
+				return err
+			}
+			if r.canary != nil {
+				if start, err = r.runCanary(name, &tmp, size); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := r.migrate(name, &tmp, start, size); err != nil {
+			return err
+		}
+		fallthrough
+
+	case rolloutPhaseDeleteOriginal:
+		if err := r.enterPhase(rolloutPhaseDeleteOriginal); err != nil {
+			return err
+		}
+		if err := r.deleteNodePool(name); err != nil {
+			return err
+		}
+		fallthrough
+
+	case rolloutPhaseMoveToNew:
+		if err := r.enterPhase(rolloutPhaseMoveToNew); err != nil {
+			return err
+		}
+
+		start, exists, err := r.nodePoolSize(name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			start = -1
+		}
+
+		if err := r.migrate(tmpName, desired, start, size); err != nil {
+			return err
+		}
+		fallthrough
+
+	case rolloutPhaseDeleteTemporary:
+		if err := r.enterPhase(rolloutPhaseDeleteTemporary); err != nil {
+			return err
+		}
+		if err := r.deleteNodePool(tmpName); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown rollout phase %q", phase)
+	}
+
+	return r.enterPhase(rolloutPhaseDone)
+}
+
+// enterPhase reports the start of a phase to onPhase, if set.
+func (r *nodePoolRollout) enterPhase(phase string) error {
+	if err := clusterRolloutLeases.lost(r.nodePoolInfo.lockKey()); err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] Rollout entering phase %s", phase)
+	r.tracePhase(phase)
+	r.metrics.enterPhase(phase)
+	if r.onPhase == nil {
+		return nil
+	}
+	return r.onPhase(phase)
+}
+
+func (r *nodePoolRollout) metricsKey() poolMetricsKey {
+	return poolMetricsKey{
+		project: r.nodePoolInfo.project,
+		cluster: r.nodePoolInfo.cluster,
+		pool:    r.pool,
+	}
+}
+
+// startTrace begins the root span of the rollout.
+func (r *nodePoolRollout) startTrace(phase string) {
+	r.span = r.config.tracer.startTrace("rollout "+r.pool, spanKindInternal)
+	r.span.setAttribute("rollgcp.project", r.nodePoolInfo.project)
+	r.span.setAttribute("rollgcp.location", r.nodePoolInfo.location)
+	r.span.setAttribute("rollgcp.cluster", r.nodePoolInfo.cluster)
+	r.span.setAttribute("rollgcp.node_pool", r.pool)
+	r.span.setAttribute("rollgcp.start_phase", phase)
+}
+
+// tracePhase ends the span of the previous phase and begins one for phase.
+// Requests to the Kubernetes API are made in the context of the phase span.
+func (r *nodePoolRollout) tracePhase(phase string) {
+	r.config.tracer.deactivate(r.phaseSpan)
+	r.phaseSpan.finish(nil)
+	r.phaseSpan = nil
+	if phase == rolloutPhaseDone {
+		r.kube.context = r.config.context
+		return
+	}
+
+	r.phaseSpan = r.config.tracer.start(r.span, "phase "+phase, spanKindInternal)
+	r.config.tracer.activate(r.phaseSpan)
+	if r.phaseSpan != nil {
+		r.kube.context = contextWithSpan(r.config.context, r.phaseSpan)
+	}
+}
+
+// endTrace ends the spans of the rollout, as failed if err is set, and sends
+// them.
+func (r *nodePoolRollout) endTrace(err error) {
+	r.config.tracer.deactivate(r.phaseSpan)
+	r.phaseSpan.finish(err)
+	r.phaseSpan = nil
+	r.span.finish(err)
+	r.span = nil
+	r.kube.context = r.config.context
+}
+
+// deleteNodePool deletes the drained node pool, unless it is already gone.
+func (r *nodePoolRollout) deleteNodePool(name string) error {
+	_, exists, err := r.nodePoolSize(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Printf("[DEBUG] GKE NodePool %s is already gone", name)
+		return nil
+	}
+
+	log.Printf("[INFO] GKE NodePool %s has been drained, deleting it", name)
+	return containerNodePoolDelete(r.config, r.nodePoolInfo, name, r.userAgent, r.timeout())
+}
+
+// migrate creates the node pool to and grows it to size nodes per zone in
+// batches, cordoning and draining a matching batch of nodes from the pool
+// named from after each step. A start of zero or more means to already exists
+// with start nodes per zone; a negative start means it has to be created.
+func (r *nodePoolRollout) migrate(from string, to *containerBeta.NodePool, start, size int64) (err error) {
+	log.Printf("[INFO] GKE Pods are moving from NodePool %s to NodePool %s", from, to.Name)
+
+	// Every node of from is drained by the end, so steer pods evicted from
+	// elsewhere in the cluster away from them from the start. If the rollout
+	// stops short, the nodes left serving pods must not keep the taint.
+	defer func() {
+		if err != nil {
+			r.untaintRemainingNodes(from)
+		}
+	}()
+	if err := r.taintDrainingNodes(from); err != nil {
+		return err
+	}
+
+	var toZones int64
+	current := start
+	created := start >= 0
+	if !created {
+		current = 0
+	} else {
+		if toZones, err = r.zoneCount(to.Name); err != nil {
+			return err
+		}
+	}
+	for !created || current < size {
+		step, early := r.settings.nextStep(current, size)
+
+		// Take down the unavailable share first so the extra capacity in the
+		// cluster never exceeds the surge.
+		if err := r.drainNextNodes(from, early); err != nil {
+			return err
+		}
+
+		current += step
+		if !created {
+			spec := *to
+			spec.InitialNodeCount = current
+			if err := r.createNodePool(&spec); err != nil {
+				return err
+			}
+			created = true
+
+			if toZones, err = r.zoneCount(to.Name); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("[INFO] GKE NodePool %s is being resized to %d nodes per zone", to.Name, current)
+			if err := containerNodePoolSetSize(r.config, r.nodePoolInfo, to.Name, current, r.userAgent, r.timeout()); err != nil {
+				return err
+			}
+		}
+
+		if err := r.awaitReadyNodes(to.Name, current*toZones); err != nil {
+			return err
+		}
+		if err := r.labelTemporaryNodes(to.Name); err != nil {
+			return err
+		}
+
+		if err := r.drainNextNodes(from, step-early); err != nil {
+			return err
+		}
+	}
+
+	// The source pool may have been larger than the destination, for example
+	// when node_count was lowered; drain whatever is left.
+	return r.drainNextNodes(from, -1)
+}
+
+// createNodePool creates the node pool and waits for it to settle. If the
+// temporary node pool fails to come up because of a stockout, it is retried in
+// the fallback zones.
+func (r *nodePoolRollout) createNodePool(nodePool *containerBeta.NodePool) error {
+	err := r.createNodePoolOnce(nodePool)
+	if err == nil || nodePool.Name != r.temporaryName() || len(r.fallbackZones) == 0 || !isStockoutError(err) {
+		return err
+	}
+	return r.createTemporaryNodePoolInFallbackZones(nodePool, err)
+}
+
+func (r *nodePoolRollout) createNodePoolOnce(nodePool *containerBeta.NodePool) error {
+	log.Printf("[INFO] GKE NodePool %s is being created with %d nodes per zone", nodePool.Name, nodePool.InitialNodeCount)
+
+	if err := containerNodePoolCreate(r.config, r.nodePoolInfo, nodePool, r.userAgent, r.timeout()); err != nil {
+		return err
+	}
+
+	state, err := containerNodePoolAwaitRestingState(r.config, r.nodePoolInfo.fullyQualifiedName(nodePool.Name), r.nodePoolInfo.project, r.userAgent, r.timeout())
+	if err != nil {
+		return err
+	}
+	if containerNodePoolRestingStates[state] == ErrorState {
+		return containerNodePoolErrorStateError(r.config, r.nodePoolInfo, nodePool.Name, r.userAgent, state)
+	}
+
+	return nil
+}
+
+// getNodePool reads the named node pool from the API.
+func (r *nodePoolRollout) getNodePool(name string) (*containerBeta.NodePool, error) {
+	nodePool, err := r.config.getNodePool(r.nodePoolInfo.fullyQualifiedName(name), r.nodePoolInfo.project, r.userAgent)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading NodePool %s: %s", name, err)
+	}
+	return nodePool, nil
+}
+
+// zoneCount returns the number of zones the named node pool spans, which is
+// the number of nodes each per-zone size step adds or removes.
+func (r *nodePoolRollout) zoneCount(name string) (int64, error) {
+	nodePool, err := r.getNodePool(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(nodePool.Locations) == 0 {
+		return 1, nil
+	}
+	return int64(len(nodePool.Locations)), nil
+}
+
+// nodePoolSize returns the size per zone of the named node pool, read from
+// its instance groups, and whether the pool exists at all.
+func (r *nodePoolRollout) nodePoolSize(name string) (int64, bool, error) {
+	nodePool, err := r.config.getNodePool(r.nodePoolInfo.fullyQualifiedName(name), r.nodePoolInfo.project, r.userAgent)
+	if isGoogleApiErrorWithCode(err, 404) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("Error reading NodePool %s: %s", name, err)
+	}
+
+	igms, err := nodePoolInstanceGroupManagers(r.config, nodePool.InstanceGroupUrls, r.userAgent)
+	if err != nil {
+		return 0, false, err
+	}
+	var size, groups int64
+	for _, igm := range igms {
+		size += igm.TargetSize
+		groups++
+	}
+	if groups == 0 {
+		return 0, true, nil
+	}
+	return size / groups, true, nil
+}
+
+// listNodePoolNodes returns the nodes of the named pool.
+func (r *nodePoolRollout) listNodePoolNodes(pool string) ([]KubernetesNode, error) {
+	if pool == r.temporaryName() {
+		return r.kube.ListNodes(fmt.Sprintf("%s=%s", temporaryNodePoolLabel, r.pool))
+	}
+	return r.kube.ListNodes(fmt.Sprintf("%s=%s,!%s", gkeNodePoolLabel, pool, temporaryNodePoolLabel))
+}
+
+// awaitReadyNodes waits until at least count nodes of the named pool have
+// registered with the cluster and are Ready.
+func (r *nodePoolRollout) awaitReadyNodes(name string, count int64) error {
+	return resource.Retry(r.timeout(), func() *resource.RetryError {
+		nodes, err := r.listNodePoolNodes(name)
+		if err != nil {
+			return resource.NonRetryableError(err)
+		}
+		var ready int64
+		for i := range nodes {
+			if nodes[i].IsReady() {
+				ready++
+			}
+		}
+		if ready < count {
+			return resource.RetryableError(fmt.Errorf("NodePool %s has %d of %d nodes ready", name, ready, count))
+		}
+		log.Printf("[DEBUG] NodePool %s has %d nodes ready", name, ready)
+		return nil
+	})
+}
+
+// drainNextNodes cordons and drains up to perZone nodes in each zone of the
+// named pool that are not drained yet, see isDrained. A negative perZone
+// drains every remaining node.
+func (r *nodePoolRollout) drainNextNodes(pool string, perZone int64) error {
+	if perZone == 0 {
+		return nil
+	}
+	if err := clusterRolloutLeases.lost(r.nodePoolInfo.lockKey()); err != nil {
+		return err
+	}
+
+	nodes, err := r.listNodePoolNodes(pool)
+	if err != nil {
+		return err
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Metadata.Name < nodes[j].Metadata.Name
+	})
+
+	batch := []string{}
+	taken := map[string]int64{}
+	for i := range nodes {
+		zone := nodes[i].zone()
+		if perZone >= 0 && taken[zone] >= perZone {
+			continue
+		}
+		drained, err := r.isDrained(&nodes[i])
+		if err != nil {
+			return err
+		}
+		if drained {
+			continue
+		}
+		taken[zone]++
+		batch = append(batch, nodes[i].Metadata.Name)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	log.Printf("[INFO] Draining nodes %v of NodePool %s", batch, pool)
+	return r.drainNodes(batch)
+}
+
+// interleaveZones orders the nodes by name within each zone and takes them
+// from the zones in turn, so that every prefix of the result is spread evenly
+// over the zones.
+func interleaveZones(nodes []KubernetesNode) []KubernetesNode {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Metadata.Name < nodes[j].Metadata.Name
+	})
+	zones := []string{}
+	byZone := map[string][]KubernetesNode{}
+	for _, node := range nodes {
+		zone := node.zone()
+		if _, ok := byZone[zone]; !ok {
+			zones = append(zones, zone)
+		}
+		byZone[zone] = append(byZone[zone], node)
+	}
+	sort.Strings(zones)
+
+	interleaved := make([]KubernetesNode, 0, len(nodes))
+	for i := 0; len(interleaved) < len(nodes); i++ {
+		for _, zone := range zones {
+			if i < len(byZone[zone]) {
+				interleaved = append(interleaved, byZone[zone][i])
+			}
+		}
+	}
+	return interleaved
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
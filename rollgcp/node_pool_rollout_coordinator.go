@@ -0,0 +1,144 @@
+package rollgcp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The taint put on the nodes of a pool that is being drained, so that pods
+// evicted by the rollout of another pool of the cluster are not scheduled on
+// them. The pods that already run on the nodes stay until they are drained.
+var drainingNodeTaint = KubernetesTaint{
+	Key:    "rollgcp/draining",
+	Value:  "true",
+	Effect: "NoSchedule",
+}
+
+// rolloutCoordinator limits the number of node pools of a cluster that are
+// rolled at the same time. Each cluster gets a semaphore, keyed like mutexKV.
+type rolloutCoordinator struct {
+	lock     sync.Mutex
+	clusters map[string]*clusterRollouts
+}
+
+type clusterRollouts struct {
+	slots chan struct{}
+	// active holds the names of the node pools being rolled.
+	active map[string]bool
+}
+
+var nodePoolRolloutCoordinator = &rolloutCoordinator{
+	clusters: make(map[string]*clusterRollouts),
+}
+
+func (c *rolloutCoordinator) get(key string, limit int) *clusterRollouts {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cluster, ok := c.clusters[key]
+	if !ok {
+		cluster = &clusterRollouts{
+			slots:  make(chan struct{}, limit),
+			active: make(map[string]bool),
+		}
+		c.clusters[key] = cluster
+	}
+	return cluster
+}
+
+func (c *rolloutCoordinator) activePools(cluster *clusterRollouts) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pools := make([]string, 0, len(cluster.active))
+	for pool := range cluster.active {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	return pools
+}
+
+// acquire waits up to timeout for one of the limit rollout slots of the
+// cluster identified by key, and returns the function that gives it back.
+func (c *rolloutCoordinator) acquire(key, pool string, limit int, timeout time.Duration) (func(), error) {
+	cluster := c.get(key, limit)
+
+	select {
+	case cluster.slots <- struct{}{}:
+	default:
+		log.Printf("[INFO] Waiting to roll NodePool %s while NodePools %v of the cluster are being rolled", pool, c.activePools(cluster))
+		select {
+		case cluster.slots <- struct{}{}:
+		case <-time.After(timeout):
+			return nil, fmt.Errorf("timed out waiting to roll NodePool %s: NodePools %v of the cluster are being rolled, and max_concurrent_pool_rollouts is %d", pool, c.activePools(cluster), limit)
+		}
+	}
+
+	c.lock.Lock()
+	cluster.active[pool] = true
+	c.lock.Unlock()
+	log.Printf("[DEBUG] Rolling NodePool %s; NodePools %v of the cluster are being rolled", pool, c.activePools(cluster))
+
+	return func() {
+		c.lock.Lock()
+		delete(cluster.active, pool)
+		c.lock.Unlock()
+		<-cluster.slots
+	}, nil
+}
+
+// taintDrainingNodes marks every node of the named pool with the draining
+// taint ahead of the drains.
+func (r *nodePoolRollout) taintDrainingNodes(pool string) error {
+	nodes, err := r.listNodePoolNodes(pool)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(nodes))
+	for i := range nodes {
+		names = append(names, nodes[i].Metadata.Name)
+	}
+	return r.setDrainingTaint(names, true)
+}
+
+// untaintRemainingNodes removes the draining taint from the nodes of the
+// named pool that have not been cordoned, after a rollout stopped short of
+// draining them. It runs even once the rollout's context has been cancelled,
+// and only logs failures, which would hide the error that stopped the
+// rollout.
+func (r *nodePoolRollout) untaintRemainingNodes(pool string) {
+	ctx := r.kube.context
+	r.kube.context = contextWithSpan(context.Background(), spanFromContext(ctx))
+	defer func() { r.kube.context = ctx }()
+
+	nodes, err := r.listNodePoolNodes(pool)
+	if err != nil {
+		log.Printf("[WARN] Unable to remove taint %s from the nodes of NodePool %s: %s", drainingNodeTaint.Key, pool, err)
+		return
+	}
+	names := []string{}
+	for i := range nodes {
+		if !nodes[i].Spec.Unschedulable {
+			names = append(names, nodes[i].Metadata.Name)
+		}
+	}
+	if err := r.setDrainingTaint(names, false); err != nil {
+		log.Printf("[WARN] Unable to remove taint %s from the nodes of NodePool %s: %s", drainingNodeTaint.Key, pool, err)
+	}
+}
+
+// setDrainingTaint adds or removes the draining taint on the named nodes.
+func (r *nodePoolRollout) setDrainingTaint(nodeNames []string, present bool) error {
+	for _, name := range nodeNames {
+		log.Printf("[DEBUG] Setting taint %s on node %s: %t", drainingNodeTaint.Key, name, present)
+		if err := r.kube.SetNodeTaint(name, drainingNodeTaint, present); err != nil {
+			if isKubernetesApiErrorWithCode(err, 404) {
+				continue
+			}
+			return fmt.Errorf("Error setting taint %s on node %s: %s", drainingNodeTaint.Key, name, err)
+		}
+	}
+	return nil
+}
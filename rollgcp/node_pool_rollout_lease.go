@@ -0,0 +1,215 @@
+package rollgcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The Lease that marks a cluster as being rolled, so that rollouts from other
+// processes, such as a second CI pipeline or the roll command, keep off it.
+const (
+	rolloutLeaseNamespace = "kube-system"
+	rolloutLeaseName      = "rollgcp-node-pool-rollout"
+	// rolloutLeaseDuration is how long the Lease holds without renewal, so
+	// how long a crashed rollout blocks the cluster for. It is renewed three
+	// times as often.
+	rolloutLeaseDuration = 60 * time.Second
+)
+
+// rolloutLeaseHolder identifies this process in the Lease. The random suffix
+// keeps CI runners with the same hostname and PID apart.
+var rolloutLeaseHolder = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("rollgcp@%s/%d/%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}()
+
+// rolloutLeases holds the cluster Leases of this process. Node pools of a
+// cluster rolled by this process at the same time share its Lease, which is
+// released with the last of them.
+type rolloutLeases struct {
+	lock sync.Mutex
+	held map[string]*heldRolloutLease
+}
+
+type heldRolloutLease struct {
+	lock  sync.Mutex
+	kube  *KubernetesClient
+	lease *KubernetesLease
+	// err is set once the Lease can no longer be renewed.
+	err  error
+	refs int
+	stop chan struct{}
+	done chan struct{}
+}
+
+var clusterRolloutLeases = &rolloutLeases{
+	held: make(map[string]*heldRolloutLease),
+}
+
+// acquire takes the rollout Lease of the cluster identified by key, or joins
+// this process's hold on it, and keeps it renewed until the returned function
+// is called. It fails at once, naming the holder, if another process holds
+// the Lease.
+func (l *rolloutLeases) acquire(key string, kube *KubernetesClient) (func(), error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	h, ok := l.held[key]
+	if !ok {
+		lease, err := takeRolloutLease(kube)
+		if err != nil {
+			return nil, err
+		}
+		h = &heldRolloutLease{
+			kube:  kube,
+			lease: lease,
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		l.held[key] = h
+		go h.renew()
+	}
+	h.refs++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(key, h) })
+	}, nil
+}
+
+func (l *rolloutLeases) release(key string, h *heldRolloutLease) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+	delete(l.held, key)
+	close(h.stop)
+	<-h.done
+
+	if h.err != nil {
+		return
+	}
+	log.Printf("[DEBUG] Releasing Lease %s/%s", rolloutLeaseNamespace, rolloutLeaseName)
+	if err := h.kube.DeleteLease(h.lease); err != nil && !isKubernetesApiErrorWithCode(err, 404) {
+		log.Printf("[WARN] Unable to release Lease %s/%s, it lapses in %s: %s", rolloutLeaseNamespace, rolloutLeaseName, rolloutLeaseDuration, err)
+	}
+}
+
+// lost returns an error if this process's Lease on the cluster identified by
+// key could not be renewed, in which case the rollout must stop.
+func (l *rolloutLeases) lost(key string) error {
+	l.lock.Lock()
+	h, ok := l.held[key]
+	l.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.err
+}
+
+// takeRolloutLease creates the Lease, or takes it over if it has lapsed.
+func takeRolloutLease(kube *KubernetesClient) (*KubernetesLease, error) {
+	now := time.Now()
+
+	lease, err := kube.GetLease(rolloutLeaseNamespace, rolloutLeaseName)
+	if isKubernetesApiErrorWithCode(err, 404) {
+		lease = &KubernetesLease{}
+		lease.Metadata.Name = rolloutLeaseName
+		lease.Metadata.Namespace = rolloutLeaseNamespace
+		fillRolloutLease(lease, now)
+
+		created, err := kube.CreateLease(lease)
+		if isKubernetesApiErrorWithCode(err, 409) {
+			return nil, fmt.Errorf("Another process took Lease %s/%s at the same time; the cluster is being rolled elsewhere", rolloutLeaseNamespace, rolloutLeaseName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error creating Lease %s/%s: %s", rolloutLeaseNamespace, rolloutLeaseName, err)
+		}
+		log.Printf("[INFO] Acquired Lease %s/%s as %s", rolloutLeaseNamespace, rolloutLeaseName, rolloutLeaseHolder)
+		return created, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Lease %s/%s: %s", rolloutLeaseNamespace, rolloutLeaseName, err)
+	}
+
+	if holder := lease.Spec.HolderIdentity; holder != "" && holder != rolloutLeaseHolder && lease.expiry().After(now) {
+		return nil, fmt.Errorf("The cluster is being rolled by %s, which holds Lease %s/%s until %s; wait for it to finish, or delete the Lease if that rollout is known to be dead", holder, rolloutLeaseNamespace, rolloutLeaseName, lease.expiry().Format(time.RFC3339))
+	}
+
+	if lease.Spec.HolderIdentity != "" && lease.Spec.HolderIdentity != rolloutLeaseHolder {
+		log.Printf("[WARN] Taking over Lease %s/%s from %s, which let it lapse", rolloutLeaseNamespace, rolloutLeaseName, lease.Spec.HolderIdentity)
+	}
+	fillRolloutLease(lease, now)
+	lease.Spec.LeaseTransitions++
+	updated, err := kube.UpdateLease(lease)
+	if isKubernetesApiErrorWithCode(err, 409) {
+		return nil, fmt.Errorf("Another process took Lease %s/%s at the same time; the cluster is being rolled elsewhere", rolloutLeaseNamespace, rolloutLeaseName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error updating Lease %s/%s: %s", rolloutLeaseNamespace, rolloutLeaseName, err)
+	}
+	log.Printf("[INFO] Acquired Lease %s/%s as %s", rolloutLeaseNamespace, rolloutLeaseName, rolloutLeaseHolder)
+	return updated, nil
+}
+
+func fillRolloutLease(lease *KubernetesLease, now time.Time) {
+	lease.Spec.HolderIdentity = rolloutLeaseHolder
+	lease.Spec.LeaseDurationSeconds = int64(rolloutLeaseDuration / time.Second)
+	lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTimeFormat)
+	lease.Spec.RenewTime = lease.Spec.AcquireTime
+}
+
+// renew keeps the Lease alive until stop is closed. If the Lease is taken by
+// someone else, or cannot be renewed before it lapses, err is set.
+func (h *heldRolloutLease) renew() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(rolloutLeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.lock.Lock()
+		lease := *h.lease
+		lease.Spec.RenewTime = time.Now().UTC().Format(kubernetesMicroTimeFormat)
+		updated, err := h.kube.UpdateLease(&lease)
+		switch {
+		case err == nil:
+			h.lease = updated
+		case isKubernetesApiErrorWithCode(err, 404) || isKubernetesApiErrorWithCode(err, 409):
+			h.err = fmt.Errorf("Lost Lease %s/%s to another process; stopping the rollout", rolloutLeaseNamespace, rolloutLeaseName)
+		case time.Now().After(h.lease.expiry()):
+			h.err = fmt.Errorf("Lease %s/%s lapsed, since it could not be renewed: %s", rolloutLeaseNamespace, rolloutLeaseName, err)
+		default:
+			log.Printf("[WARN] Unable to renew Lease %s/%s, retrying: %s", rolloutLeaseNamespace, rolloutLeaseName, err)
+		}
+		failed := h.err
+		h.lock.Unlock()
+
+		if failed != nil {
+			log.Printf("[ERROR] %s", failed)
+			return
+		}
+	}
+}
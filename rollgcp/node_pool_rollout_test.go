@@ -0,0 +1,33 @@
+package rollgcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterleaveZones(t *testing.T) {
+	node := func(name, zone string) KubernetesNode {
+		var n KubernetesNode
+		n.Metadata.Name = name
+		n.Metadata.Labels = map[string]string{kubernetesZoneLabel: zone}
+		return n
+	}
+	// GKE names nodes after the instance group of their zone, so sorting by
+	// name alone groups them by zone.
+	nodes := []KubernetesNode{
+		node("gke-pool-bbbb-2", "us-central1-b"),
+		node("gke-pool-aaaa-1", "us-central1-a"),
+		node("gke-pool-bbbb-1", "us-central1-b"),
+		node("gke-pool-aaaa-2", "us-central1-a"),
+		node("gke-pool-aaaa-3", "us-central1-a"),
+	}
+
+	var names []string
+	for _, n := range interleaveZones(nodes) {
+		names = append(names, n.Metadata.Name)
+	}
+	want := []string{"gke-pool-aaaa-1", "gke-pool-bbbb-1", "gke-pool-aaaa-2", "gke-pool-bbbb-2", "gke-pool-aaaa-3"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("expected %v, got %v", want, names)
+	}
+}
@@ -0,0 +1,206 @@
+package rollgcp
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	containerBeta "google.golang.org/api/container/v1beta1"
+)
+
+var schemaNodePoolTemporaryPoolOverrides = &schema.Schema{
+	Type:        schema.TypeList,
+	Optional:    true,
+	MaxItems:    1,
+	Description: `Changes applied to the new node_config when it is used for the temporary node pool, for example to use a cheaper machine type for the transit pool.`,
+	Elem: &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"labels": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: `Kubernetes labels added to the temporary node pool's nodes, replacing node_config labels with the same key.`,
+			},
+
+			"taint": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: `Kubernetes taints added to the temporary node pool's nodes.`,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"key": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"value": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"effect": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringInSlice([]string{"NO_SCHEDULE", "PREFER_NO_SCHEDULE", "NO_EXECUTE"}, false),
+						},
+					},
+				},
+			},
+
+			"machine_type": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: `The machine type of the temporary node pool.`,
+			},
+
+			"preemptible": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: `Whether the temporary node pool's nodes are preemptible.`,
+			},
+		},
+	},
+}
+
+type temporaryPoolOverrides struct {
+	labels      map[string]string
+	taints      []*containerBeta.NodeTaint
+	machineType string
+	preemptible *bool
+}
+
+func expandTemporaryPoolOverrides(d *schema.ResourceData) *temporaryPoolOverrides {
+	v, ok := d.GetOk("temporary_pool_overrides")
+	if !ok {
+		return nil
+	}
+	ls := v.([]interface{})
+	if len(ls) == 0 || ls[0] == nil {
+		return nil
+	}
+	cfg := ls[0].(map[string]interface{})
+
+	overrides := &temporaryPoolOverrides{
+		labels:      map[string]string{},
+		machineType: cfg["machine_type"].(string),
+	}
+	for k, v := range cfg["labels"].(map[string]interface{}) {
+		overrides.labels[k] = v.(string)
+	}
+	for _, raw := range cfg["taint"].([]interface{}) {
+		data := raw.(map[string]interface{})
+		overrides.taints = append(overrides.taints, &containerBeta.NodeTaint{
+			Key:    data["key"].(string),
+			Value:  data["value"].(string),
+			Effect: data["effect"].(string),
+		})
+	}
+	// preemptible has no natural unset value, so only override it when it is
+	// present in the configuration.
+	if v, ok := d.GetOkExists("temporary_pool_overrides.0.preemptible"); ok {
+		preemptible := v.(bool)
+		overrides.preemptible = &preemptible
+	}
+
+	return overrides
+}
+
+// apply returns a copy of nc with the overrides applied. The copy's labels
+// can be modified without affecting nc.
+func (o *temporaryPoolOverrides) apply(nc *containerBeta.NodeConfig) *containerBeta.NodeConfig {
+	result := *nc
+	result.Labels = map[string]string{}
+	for k, v := range nc.Labels {
+		result.Labels[k] = v
+	}
+	if o == nil {
+		return &result
+	}
+
+	for k, v := range o.labels {
+		result.Labels[k] = v
+	}
+
+	result.Taints = append(append([]*containerBeta.NodeTaint{}, nc.Taints...), o.taints...)
+
+	if o.machineType != "" {
+		result.MachineType = o.machineType
+	}
+	if o.preemptible != nil {
+		result.Preemptible = *o.preemptible
+	}
+
+	return &result
+}
+
+var (
+	kubernetesLabelNameRegexp  = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)$`)
+	kubernetesLabelValueRegexp = regexp.MustCompile(`^(([A-Za-z0-9][-A-Za-z0-9_.]{0,61})?[A-Za-z0-9])?$`)
+	machineTypeRegexp          = regexp.MustCompile(`^[a-z][a-z0-9]*-[a-z0-9-]+$`)
+)
+
+// validateKubernetesLabelKey checks a label key of the form [prefix/]name.
+func validateKubernetesLabelKey(key string) error {
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if prefix == "" || len(prefix) > 253 {
+			return fmt.Errorf("label key %q has an invalid prefix", key)
+		}
+	}
+	if !kubernetesLabelNameRegexp.MatchString(name) {
+		return fmt.Errorf("label key %q is not a valid Kubernetes label name", key)
+	}
+	return nil
+}
+
+// validateTemporaryPoolOverrides checks the temporary_pool_overrides block
+// against the Kubernetes label rules and the node pool's own node_config.
+func validateTemporaryPoolOverrides(_ context.Context, diff *schema.ResourceDiff, meta interface{}) error {
+	if _, ok := diff.GetOk("temporary_pool_overrides"); !ok {
+		return nil
+	}
+
+	for k, v := range diff.Get("temporary_pool_overrides.0.labels").(map[string]interface{}) {
+		if err := validateKubernetesLabelKey(k); err != nil {
+			return fmt.Errorf("temporary_pool_overrides: %s", err)
+		}
+		if k == gkeNodePoolLabel || k == temporaryNodePoolLabel {
+			return fmt.Errorf("temporary_pool_overrides: label %q is managed by the provider and cannot be overridden", k)
+		}
+		if strings.Contains(k, "kubernetes.io/") || strings.Contains(k, "k8s.io/") {
+			return fmt.Errorf("temporary_pool_overrides: label %q uses a prefix reserved by Kubernetes", k)
+		}
+		if !kubernetesLabelValueRegexp.MatchString(v.(string)) {
+			return fmt.Errorf("temporary_pool_overrides: label %q has an invalid value %q", k, v)
+		}
+	}
+
+	type taintKey struct {
+		key, effect string
+	}
+	taints := map[taintKey]bool{}
+	for _, raw := range diff.Get("node_config.0.taint").([]interface{}) {
+		data := raw.(map[string]interface{})
+		taints[taintKey{data["key"].(string), data["effect"].(string)}] = true
+	}
+	for _, raw := range diff.Get("temporary_pool_overrides.0.taint").([]interface{}) {
+		data := raw.(map[string]interface{})
+		tk := taintKey{data["key"].(string), data["effect"].(string)}
+		if err := validateKubernetesLabelKey(tk.key); err != nil {
+			return fmt.Errorf("temporary_pool_overrides: taint %s", err)
+		}
+		if taints[tk] {
+			return fmt.Errorf("temporary_pool_overrides: taint %q with effect %s is already set, in node_config or in an earlier taint block", tk.key, tk.effect)
+		}
+		taints[tk] = true
+	}
+
+	if machineType := diff.Get("temporary_pool_overrides.0.machine_type").(string); machineType != "" && !machineTypeRegexp.MatchString(machineType) {
+		return fmt.Errorf("temporary_pool_overrides: %q is not a valid machine type", machineType)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package rollgcp
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	container "google.golang.org/api/container/v1beta1"
+)
+
+// The default bounds of the wait between two polls of a long-running
+// operation.
+const (
+	defaultOperationPollInterval    = 10 * time.Second
+	defaultOperationPollMaxInterval = 60 * time.Second
+)
+
+// Once an operation reports this share of its work as done, polling falls
+// back to the shortest interval so its end is noticed quickly.
+const operationNearlyDoneProgress = 0.8
+
+// operationPoller spaces out the polls of a long-running operation. The wait
+// doubles after every poll, from the configured interval up to the maximum,
+// and is jittered so that rollouts started together do not poll in step.
+type operationPoller struct {
+	min, max, next time.Duration
+}
+
+func newOperationPoller(config *Config) *operationPoller {
+	p := &operationPoller{
+		min: config.PollInterval,
+		max: config.PollMaxInterval,
+	}
+	if p.min <= 0 {
+		p.min = defaultOperationPollInterval
+	}
+	if p.max < p.min {
+		p.max = p.min
+	}
+	p.next = p.min
+	return p
+}
+
+// delay returns how long to wait before the next poll, given the share of
+// the work the operation reports as done, or a negative progress if unknown.
+func (p *operationPoller) delay(progress float64) time.Duration {
+	if progress >= operationNearlyDoneProgress {
+		p.next = p.min
+	}
+
+	d := p.next
+	p.next *= 2
+	if p.next > p.max {
+		p.next = p.max
+	}
+
+	// Keep at least half the wait, so the jitter never turns into a burst of
+	// back to back polls.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// pollWithBackoff calls refresh until it returns nil or a non-retryable
+// error, waiting between calls as operationPoller prescribes. refresh also
+// returns the progress of the awaited work, negative if unknown. If timeout
+// passes first, the last retryable error is returned in a
+// resource.TimeoutError.
+func pollWithBackoff(config *Config, timeout time.Duration, refresh func() (float64, *resource.RetryError)) error {
+	poller := newOperationPoller(config)
+	deadline := time.Now().Add(timeout)
+
+	var cancelled <-chan struct{}
+	if config.context != nil {
+		cancelled = config.context.Done()
+	}
+
+	for {
+		progress, rerr := refresh()
+		if rerr == nil {
+			return nil
+		}
+		if !rerr.Retryable {
+			return rerr.Err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return &resource.TimeoutError{
+				LastError: rerr.Err,
+				Timeout:   timeout,
+			}
+		}
+		wait := poller.delay(progress)
+		if wait > remaining {
+			wait = remaining
+		}
+		log.Printf("[TRACE] Polling again in %s: %s", wait, rerr.Err)
+
+		select {
+		case <-time.After(wait):
+		case <-cancelled:
+			return fmt.Errorf("unable to finish polling, context has been cancelled")
+		}
+	}
+}
+
+// containerOperationProgress returns the share of its work the operation
+// reports as done, from its progress metrics or else its stages, or -1 if it
+// reports neither.
+func containerOperationProgress(op *container.Operation) float64 {
+	if op == nil || op.Progress == nil {
+		return -1
+	}
+	return operationProgressShare(op.Progress)
+}
+
+func operationProgressShare(progress *container.OperationProgress) float64 {
+	// Metrics come in pairs such as NODES_TOTAL and NODES_DONE, or
+	// NODES_COMPLETE.
+	values := map[string]int64{}
+	for _, m := range progress.Metrics {
+		if m != nil {
+			values[m.Name] = m.IntValue
+		}
+	}
+	var done, total int64
+	for name, v := range values {
+		if !strings.HasSuffix(name, "_TOTAL") || v <= 0 {
+			continue
+		}
+		prefix := strings.TrimSuffix(name, "_TOTAL")
+		if d, ok := values[prefix+"_DONE"]; ok {
+			done, total = done+d, total+v
+		} else if d, ok := values[prefix+"_COMPLETE"]; ok {
+			done, total = done+d, total+v
+		}
+	}
+	if total > 0 {
+		return float64(done) / float64(total)
+	}
+
+	if len(progress.Stages) > 0 {
+		var finished int
+		for _, stage := range progress.Stages {
+			if stage != nil && stage.Status == "DONE" {
+				finished++
+			}
+		}
+		return float64(finished) / float64(len(progress.Stages))
+	}
+
+	return -1
+}
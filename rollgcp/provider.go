@@ -8,6 +8,7 @@ import (
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 	glBeta "github.com/hashicorp/terraform-provider-google-beta/google-beta"
 	"github.com/hashicorp/terraform-provider-google-beta/version"
 
@@ -42,6 +43,18 @@ func Provider() *schema.Provider {
 				}, nil),
 				ConflictsWith: []string{"credentials"},
 			},
+
+			"access_token_command": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"credentials", "access_token", "access_token_file"},
+			},
+
+			"access_token_file": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"credentials", "access_token", "access_token_command"},
+			},
 			"impersonate_service_account": {
 				Type:     schema.TypeString,
 				Optional: true,
@@ -122,6 +135,94 @@ func Provider() *schema.Provider {
 				},
 			},
 
+			"retry": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"codes": {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem: &schema.Schema{
+								Type:         schema.TypeInt,
+								ValidateFunc: validation.IntBetween(400, 599),
+							},
+						},
+						"max_attempts": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+					},
+				},
+			},
+
+			"rate_limits": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"container_qps": {
+							Type:         schema.TypeFloat,
+							Optional:     true,
+							ValidateFunc: validation.FloatAtLeast(0),
+						},
+						"compute_qps": {
+							Type:         schema.TypeFloat,
+							Optional:     true,
+							ValidateFunc: validation.FloatAtLeast(0),
+						},
+						"container_burst": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+						"compute_burst": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+					},
+				},
+			},
+
+			"telemetry": {
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"otlp_endpoint": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validation.IsURLWithHTTPorHTTPS,
+						},
+						"service_name": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
+
+			"http_proxy": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.IsURLWithScheme([]string{"http", "https", "socks5"}),
+			},
+
+			"ca_bundle": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"metrics_textfile_path": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
 			"user_project_override": {
 				Type:     schema.TypeBool,
 				Optional: true,
@@ -135,9 +236,39 @@ func Provider() *schema.Provider {
 				Optional: true,
 			},
 
-			ComputeBetaCustomEndpointEntryKey:   ComputeBetaCustomEndpointEntry,
-			ContainerCustomEndpointEntryKey:     ContainerCustomEndpointEntry,
-			ContainerBetaCustomEndpointEntryKey: ContainerBetaCustomEndpointEntry,
+			"operation_poll_interval": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateNonNegativeDuration(),
+			},
+
+			"operation_poll_max_interval": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateNonNegativeDuration(),
+			},
+
+			"dry_run": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{
+					"ROLLGCP_DRY_RUN",
+				}, false),
+			},
+
+			"max_concurrent_pool_rollouts": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+
+			ComputeCustomEndpointEntryKey:        ComputeCustomEndpointEntry,
+			ComputeBetaCustomEndpointEntryKey:    ComputeBetaCustomEndpointEntry,
+			ContainerCustomEndpointEntryKey:      ContainerCustomEndpointEntry,
+			ContainerBetaCustomEndpointEntryKey:  ContainerBetaCustomEndpointEntry,
+			IAMCredentialsCustomEndpointEntryKey: IAMCredentialsCustomEndpointEntry,
+			STSCustomEndpointEntryKey:            STSCustomEndpointEntry,
 		},
 
 		ProviderMetaSchema: map[string]*schema.Schema{
@@ -163,12 +294,17 @@ func Provider() *schema.Provider {
 
 func providerConfigure(ctx context.Context, d *schema.ResourceData, p *schema.Provider) (interface{}, diag.Diagnostics) {
 	config := Config{
-		Project:             d.Get("project").(string),
-		Region:              d.Get("region").(string),
-		Zone:                d.Get("zone").(string),
-		UserProjectOverride: d.Get("user_project_override").(bool),
-		BillingProject:      d.Get("billing_project").(string),
-		userAgent:           p.UserAgent("terraform-provider-google-beta", version.ProviderVersion),
+		Project:                   d.Get("project").(string),
+		Region:                    d.Get("region").(string),
+		Zone:                      d.Get("zone").(string),
+		UserProjectOverride:       d.Get("user_project_override").(bool),
+		BillingProject:            d.Get("billing_project").(string),
+		DryRun:                    d.Get("dry_run").(bool),
+		MaxConcurrentPoolRollouts: d.Get("max_concurrent_pool_rollouts").(int),
+		MetricsTextfilePath:       d.Get("metrics_textfile_path").(string),
+		HTTPProxy:                 d.Get("http_proxy").(string),
+		CABundle:                  d.Get("ca_bundle").(string),
+		userAgent:                 p.UserAgent("terraform-provider-google-beta", version.ProviderVersion),
 	}
 
 	if v, ok := d.GetOk("request_timeout"); ok {
@@ -178,13 +314,37 @@ func providerConfigure(ctx context.Context, d *schema.ResourceData, p *schema.Pr
 			return nil, diag.FromErr(err)
 		}
 	}
+	if v, ok := d.GetOk("operation_poll_interval"); ok {
+		var err error
+		config.PollInterval, err = time.ParseDuration(v.(string))
+		if err != nil {
+			return nil, diag.FromErr(err)
+		}
+	}
+	if v, ok := d.GetOk("operation_poll_max_interval"); ok {
+		var err error
+		config.PollMaxInterval, err = time.ParseDuration(v.(string))
+		if err != nil {
+			return nil, diag.FromErr(err)
+		}
+	}
 	// Add credential source
-	if v, ok := d.GetOk("access_token"); ok {
+	if v, ok := d.GetOk("access_token_command"); ok {
+		config.AccessTokenCommand = v.(string)
+	} else if v, ok := d.GetOk("access_token_file"); ok {
+		config.AccessTokenFile = v.(string)
+	} else if v, ok := d.GetOk("access_token"); ok {
 		config.AccessToken = v.(string)
 	} else if v, ok := d.GetOk("credentials"); ok {
 		config.Credentials = v.(string)
 	}
 
+	config.ImpersonateServiceAccount = d.Get("impersonate_service_account").(string)
+	delegates := d.Get("impersonate_service_account_delegates").([]interface{})
+	for _, delegate := range delegates {
+		config.ImpersonateServiceAccountDelegates = append(config.ImpersonateServiceAccountDelegates, delegate.(string))
+	}
+
 	scopes := d.Get("scopes").([]interface{})
 	if len(scopes) > 0 {
 		config.Scopes = make([]string, len(scopes))
@@ -198,9 +358,12 @@ func providerConfigure(ctx context.Context, d *schema.ResourceData, p *schema.Pr
 		return nil, diag.FromErr(err)
 	}
 	config.BatchingConfig = batchCfg
+	config.RetrySettings = expandProviderRetrySettings(d.Get("retry"))
+	config.RateLimits = expandProviderRateLimitSettings(d.Get("rate_limits"))
+	config.Telemetry = expandProviderTelemetrySettings(d.Get("telemetry"))
 
 	config.ComputeBasePath = ComputeDefaultBasePath
-	if value, ok := d.Get("compute_custom_endpoint").(string); ok {
+	if value, ok := d.Get(ComputeCustomEndpointEntryKey).(string); ok {
 		config.ComputeBasePath = value
 	}
 
@@ -220,6 +383,16 @@ func providerConfigure(ctx context.Context, d *schema.ResourceData, p *schema.Pr
 		config.ContainerBetaBasePath = value
 	}
 
+	config.IAMCredentialsBasePath = IAMCredentialsDefaultBasePath
+	if value, ok := d.Get(IAMCredentialsCustomEndpointEntryKey).(string); ok {
+		config.IAMCredentialsBasePath = value
+	}
+
+	config.STSBasePath = STSDefaultBasePath
+	if value, ok := d.Get(STSCustomEndpointEntryKey).(string); ok {
+		config.STSBasePath = value
+	}
+
 	stopCtx, ok := schema.StopContext(ctx)
 	if !ok {
 		stopCtx = ctx
@@ -240,9 +413,24 @@ func validateCredentials(v interface{}, k string) (warnings []string, errors []e
 	if _, err := os.Stat(creds); err == nil {
 		return
 	}
-	if _, err := googleoauth.CredentialsFromJSON(context.Background(), []byte(creds)); err != nil {
+	// The credentials are secret, so errors only name their type.
+	f, err := parseCredentialsFile([]byte(creds))
+	if err != nil {
 		errors = append(errors,
-			fmt.Errorf("JSON credentials in %q are not valid: %s", creds, err))
+			fmt.Errorf("JSON credentials in %s are not valid: %s", k, err))
+		return
+	}
+	switch f.Type {
+	case externalAccountCredentialsType, impersonatedServiceAccountCredentialsType:
+		if err := f.validate(); err != nil {
+			errors = append(errors,
+				fmt.Errorf("JSON credentials of type %q in %s are not valid: %s", f.Type, k, err))
+		}
+	default:
+		if _, err := googleoauth.CredentialsFromJSON(context.Background(), []byte(creds)); err != nil {
+			errors = append(errors,
+				fmt.Errorf("JSON credentials of type %q in %s are not valid: %s", f.Type, k, err))
+		}
 	}
 
 	return
@@ -4,6 +4,16 @@ import (
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 )
 
+var ComputeCustomEndpointEntryKey = "compute_custom_endpoint"
+var ComputeCustomEndpointEntry = &schema.Schema{
+	Type:         schema.TypeString,
+	Optional:     true,
+	ValidateFunc: validateCustomEndpoint,
+	DefaultFunc: schema.MultiEnvDefaultFunc([]string{
+		"GOOGLE_COMPUTE_CUSTOM_ENDPOINT",
+	}, ComputeDefaultBasePath),
+}
+
 var ComputeBetaDefaultBasePath = "https://www.googleapis.com/compute/beta/"
 var ComputeBetaCustomEndpointEntryKey = "compute_beta_custom_endpoint"
 var ComputeBetaCustomEndpointEntry = &schema.Schema{
@@ -37,6 +47,28 @@ var ContainerBetaCustomEndpointEntry = &schema.Schema{
 	}, ContainerBetaDefaultBasePath),
 }
 
+var IAMCredentialsDefaultBasePath = "https://iamcredentials.googleapis.com/v1/"
+var IAMCredentialsCustomEndpointEntryKey = "iam_credentials_custom_endpoint"
+var IAMCredentialsCustomEndpointEntry = &schema.Schema{
+	Type:         schema.TypeString,
+	Optional:     true,
+	ValidateFunc: validateCustomEndpoint,
+	DefaultFunc: schema.MultiEnvDefaultFunc([]string{
+		"GOOGLE_IAM_CREDENTIALS_CUSTOM_ENDPOINT",
+	}, IAMCredentialsDefaultBasePath),
+}
+
+var STSDefaultBasePath = "https://sts.googleapis.com/v1/"
+var STSCustomEndpointEntryKey = "sts_custom_endpoint"
+var STSCustomEndpointEntry = &schema.Schema{
+	Type:         schema.TypeString,
+	Optional:     true,
+	ValidateFunc: validateCustomEndpoint,
+	DefaultFunc: schema.MultiEnvDefaultFunc([]string{
+		"GOOGLE_STS_CUSTOM_ENDPOINT",
+	}, STSDefaultBasePath),
+}
+
 func validateCustomEndpoint(v interface{}, k string) (ws []string, errors []error) {
 	re := `.*/[^/]+/$`
 	return validateRegexp(re)(v, k)
@@ -0,0 +1,174 @@
+package rollgcp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSettings caps the rate of requests sent to each API. A rate of
+// zero leaves the API unlimited.
+type rateLimitSettings struct {
+	containerQPS float64
+	computeQPS   float64
+	// The bursts are the number of requests that may go out back to back to
+	// each API after a quiet spell. If zero, they are the rate rounded up.
+	containerBurst int
+	computeBurst   int
+}
+
+func expandProviderRateLimitSettings(v interface{}) *rateLimitSettings {
+	settings := &rateLimitSettings{}
+
+	ls, _ := v.([]interface{})
+	if len(ls) == 0 || ls[0] == nil {
+		return settings
+	}
+
+	cfgV := ls[0].(map[string]interface{})
+	if qps, ok := cfgV["container_qps"]; ok {
+		settings.containerQPS = qps.(float64)
+	}
+	if qps, ok := cfgV["compute_qps"]; ok {
+		settings.computeQPS = qps.(float64)
+	}
+	if burst, ok := cfgV["container_burst"]; ok {
+		settings.containerBurst = burst.(int)
+	}
+	if burst, ok := cfgV["compute_burst"]; ok {
+		settings.computeBurst = burst.(int)
+	}
+
+	return settings
+}
+
+// tokenBucket hands out tokens at rate per second, holding at most burst.
+// Callers that find it empty queue up in order by taking tokens on credit.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Ceil(rate)
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (b *tokenBucket) reserve() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back a reserved token that was not used.
+func (b *tokenBucket) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// wait blocks until a token is available or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	delay := b.reserve()
+	if delay == 0 {
+		return 0, nil
+	}
+
+	select {
+	case <-time.After(delay):
+		return delay, nil
+	case <-ctx.Done():
+		b.cancel()
+		return 0, ctx.Err()
+	}
+}
+
+// rateLimitTransport delays requests so that each API sees no more than its
+// configured rate. Requests are matched to an API by the base paths they are
+// sent to; requests to other endpoints pass straight through.
+type rateLimitTransport struct {
+	buckets  map[string]*tokenBucket
+	prefixes []rateLimitPrefix
+	internal http.RoundTripper
+}
+
+type rateLimitPrefix struct {
+	prefix string
+	api    string
+}
+
+// newRateLimitTransport wraps t with the rate limits of settings for the
+// base paths of config.
+func newRateLimitTransport(t http.RoundTripper, config *Config, settings *rateLimitSettings) http.RoundTripper {
+	r := &rateLimitTransport{
+		buckets:  map[string]*tokenBucket{},
+		internal: t,
+	}
+	add := func(api string, qps float64, burst int, basePaths ...string) {
+		if qps <= 0 {
+			return
+		}
+		r.buckets[api] = newTokenBucket(qps, burst)
+		for _, basePath := range basePaths {
+			if basePath != "" {
+				r.prefixes = append(r.prefixes, rateLimitPrefix{prefix: basePath, api: api})
+			}
+		}
+		log.Printf("[INFO] Limiting requests to the %s API to %g per second", api, qps)
+	}
+	add("container", settings.containerQPS, settings.containerBurst, config.ContainerBasePath, config.ContainerBetaBasePath)
+	add("compute", settings.computeQPS, settings.computeBurst, config.ComputeBasePath, config.ComputeBetaBasePath)
+
+	if len(r.buckets) == 0 {
+		return t
+	}
+	return r
+}
+
+// RoundTrip implements the RoundTripper interface method.
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := req.URL.String()
+	for _, p := range t.prefixes {
+		if !strings.HasPrefix(u, p.prefix) {
+			continue
+		}
+		waited, err := t.buckets[p.api].wait(req.Context())
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, fmt.Errorf("waiting for the %s API rate limit: %s", p.api, err)
+		}
+		if waited > 0 {
+			log.Printf("[DEBUG] Rate Limit: waited %s to send a request to the %s API", waited, p.api)
+		}
+		break
+	}
+	return t.internal.RoundTrip(req)
+}
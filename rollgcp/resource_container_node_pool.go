@@ -1,11 +1,14 @@
 package rollgcp
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/customdiff"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
@@ -15,11 +18,11 @@ import (
 
 func resourceContainerNodePool() *schema.Resource {
 	return &schema.Resource{
-		Create: resourceContainerNodePoolCreate,
-		Read:   resourceContainerNodePoolRead,
-		Update: resourceContainerNodePoolUpdate,
-		Delete: resourceContainerNodePoolDelete,
-		Exists: resourceContainerNodePoolExists,
+		Create:        withNodePoolMetrics("create", resourceContainerNodePoolCreate),
+		ReadContext:   resourceContainerNodePoolReadContext,
+		UpdateContext: withNodePoolMetricsContext("update", resourceContainerNodePoolUpdate),
+		Delete:        withNodePoolMetrics("delete", resourceContainerNodePoolDelete),
+		Exists:        resourceContainerNodePoolExists,
 
 		Timeouts: &schema.ResourceTimeout{
 			Create: schema.DefaultTimeout(30 * time.Minute),
@@ -30,10 +33,15 @@ func resourceContainerNodePool() *schema.Resource {
 		SchemaVersion: 1,
 		MigrateState:  resourceContainerNodePoolMigrateState,
 
-		Importer: &schema.ResourceImporter{},
+		Importer: &schema.ResourceImporter{
+			State: resourceContainerNodePoolStateImporter,
+		},
 
 		CustomizeDiff: customdiff.All(
 			resourceNodeConfigEmptyGuestAccelerator,
+			validateRolloutSettings,
+			validateTemporaryPoolOverrides,
+			validateRolloutStrategy,
 		),
 
 		Schema: mergeSchemas(
@@ -59,6 +67,14 @@ func resourceContainerNodePool() *schema.Resource {
 					ForceNew:    true,
 					Description: `The location (region or zone) of the cluster.`,
 				},
+				"rollout_strategy": schemaNodePoolRolloutStrategy,
+				"rollout":          schemaNodePoolRollout,
+				"canary":           schemaNodePoolCanary,
+				"drain":            schemaNodePoolDrain,
+
+				"pinned_workload_policy":        schemaNodePoolPinnedWorkloadPolicy,
+				"temporary_pool_overrides":      schemaNodePoolTemporaryPoolOverrides,
+				"temporary_pool_fallback_zones": schemaNodePoolTemporaryPoolFallbackZones,
 			}),
 	}
 }
@@ -195,6 +211,62 @@ var schemaNodePool = map[string]*schema.Schema{
 		Description:  `The number of nodes per instance group. This field can be used to update the number of nodes per instance group but should not be used alongside autoscaling.`,
 	},
 
+	"zonal_node_counts": {
+		Type:        schema.TypeMap,
+		Computed:    true,
+		Elem:        &schema.Schema{Type: schema.TypeInt},
+		Description: `The number of nodes in each zone of the node pool, read from its instance groups.`,
+	},
+
+	"status": {
+		Type:        schema.TypeString,
+		Computed:    true,
+		Description: `The status of the node pool.`,
+	},
+
+	"status_message": {
+		Type:        schema.TypeString,
+		Computed:    true,
+		Description: `Additional information about the current status of the node pool, if available.`,
+	},
+
+	"conditions": {
+		Type:        schema.TypeList,
+		Computed:    true,
+		Description: `Conditions that caused the current node pool state, such as GCE_STOCKOUT.`,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"code": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: `The machine-friendly code of the condition.`,
+				},
+				"canonical_code": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: `The canonical error code of the condition.`,
+				},
+				"message": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: `The human-friendly description of the condition.`,
+				},
+			},
+		},
+	},
+
+	"self_link": {
+		Type:        schema.TypeString,
+		Computed:    true,
+		Description: `The server-defined URL of the node pool.`,
+	},
+
+	"pod_ipv4_cidr_size": {
+		Type:        schema.TypeInt,
+		Computed:    true,
+		Description: `The pod CIDR block size per node in this node pool.`,
+	},
+
 	"version": {
 		Type:        schema.TypeString,
 		Optional:    true,
@@ -273,58 +345,18 @@ func resourceContainerNodePoolCreate(d *schema.ResourceData, meta interface{}) e
 
 	log.Printf("[INFO] GKE NodePool %s is being created", nodePool.Name)
 
-	mutexKV.Lock(nodePoolInfo.lockKey())
-	defer mutexKV.Unlock(nodePoolInfo.lockKey())
-
-	req := &containerBeta.CreateNodePoolRequest{
-		NodePool: nodePool,
-	}
-
-	timeout := d.Timeout(schema.TimeoutCreate)
-	startTime := time.Now()
-
 	// Set the ID before we attempt to create - that way, if we receive an error but
 	// the resource is created anyway, it will be refreshed on the next call to
 	// apply.
 	d.SetId(fmt.Sprintf("projects/%s/locations/%s/clusters/%s/nodePools/%s", nodePoolInfo.project, nodePoolInfo.location, nodePoolInfo.cluster, nodePool.Name))
 
-	var operation *containerBeta.Operation
-	err = resource.Retry(timeout, func() *resource.RetryError {
-		clusterNodePoolsCreateCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Create(nodePoolInfo.parent(), req)
-		if config.UserProjectOverride {
-			clusterNodePoolsCreateCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
-		}
-		operation, err = clusterNodePoolsCreateCall.Do()
-
-		if err != nil {
-			if isFailedPreconditionError(err) {
-				// We get failed precondition errors if the cluster is updating
-				// while we try to add the node pool.
-				return resource.RetryableError(err)
-			}
-			return resource.NonRetryableError(err)
-		}
-		return nil
-	})
+	err = containerNodePoolCreate(config, nodePoolInfo, nodePool, userAgent, d.Timeout(schema.TimeoutCreate))
 	if err != nil {
-		return fmt.Errorf("error creating NodePool: %s", err)
-	}
-	timeout -= time.Since(startTime)
-
-	waitErr := containerOperationWait(
-		config,
-		operation,
-		nodePoolInfo.project,
-		nodePoolInfo.location,
-		"creating GKE NodePool",
-		userAgent,
-		timeout,
-	)
-
-	if waitErr != nil {
-		// The resource didn't actually create
-		d.SetId("")
-		return waitErr
+		if _, ok := err.(*containerNodePoolOperationError); ok {
+			// The resource didn't actually create
+			d.SetId("")
+		}
+		return err
 	}
 
 	log.Printf("[INFO] GKE NodePool %s has been created", nodePool.Name)
@@ -339,12 +371,24 @@ func resourceContainerNodePoolCreate(d *schema.ResourceData, meta interface{}) e
 	}
 
 	if containerNodePoolRestingStates[state] == ErrorState {
-		return fmt.Errorf("NodePool %s was created in the error state %q", nodePool.Name, state)
+		return containerNodePoolErrorStateError(config, nodePoolInfo, nodePool.Name, userAgent, state)
 	}
 
 	return nil
 }
 
+// resourceContainerNodePoolReadContext reads the node pool, warning if its
+// zones have drifted apart in size.
+func resourceContainerNodePoolReadContext(_ context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	if err := resourceContainerNodePoolRead(d, meta); err != nil {
+		return diag.FromErr(err)
+	}
+	if d.Id() == "" {
+		return nil
+	}
+	return nodePoolZoneDivergence(getNodePoolName(d.Id()), d)
+}
+
 func resourceContainerNodePoolRead(d *schema.ResourceData, meta interface{}) error {
 	config := meta.(*Config)
 	userAgent, err := generateUserAgentString(d, config.userAgent)
@@ -361,11 +405,7 @@ func resourceContainerNodePoolRead(d *schema.ResourceData, meta interface{}) err
 
 	log.Printf("[INFO] GKE NodePool %s is being read", name)
 
-	clusterNodePoolsGetCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Get(nodePoolInfo.fullyQualifiedName(name))
-	if config.UserProjectOverride {
-		clusterNodePoolsGetCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
-	}
-	nodePool, err := clusterNodePoolsGetCall.Do()
+	nodePool, err := config.getNodePool(nodePoolInfo.fullyQualifiedName(name), nodePoolInfo.project, userAgent)
 	if err != nil {
 		return handleNotFoundError(err, d, fmt.Sprintf("NodePool %q from cluster %q", name, nodePoolInfo.cluster))
 	}
@@ -391,36 +431,104 @@ func resourceContainerNodePoolRead(d *schema.ResourceData, meta interface{}) err
 	return nil
 }
 
-func resourceContainerNodePoolUpdate(d *schema.ResourceData, meta interface{}) error {
+func resourceContainerNodePoolUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	config := meta.(*Config)
 	userAgent, err := generateUserAgentString(d, config.userAgent)
 	if err != nil {
-		return err
+		return diag.FromErr(err)
 	}
 
 	nodePoolInfo, err := extractNodePoolInformation(d, config)
 	if err != nil {
-		return err
+		return diag.FromErr(err)
 	}
 	name := getNodePoolName(d.Id())
 
 	_, err = containerNodePoolAwaitRestingState(config, nodePoolInfo.fullyQualifiedName(name), nodePoolInfo.project, userAgent, d.Timeout(schema.TimeoutUpdate))
 	if err != nil {
-		return err
+		return diag.FromErr(err)
+	}
+
+	if !nodePoolRollRequired(d) {
+		return diag.FromErr(resourceContainerNodePoolRead(d, meta))
+	}
+
+	timeout := d.Timeout(schema.TimeoutUpdate)
+	if !nodePoolDryRun(d, config) {
+		startTime := time.Now()
+		release, err := nodePoolRolloutCoordinator.acquire(nodePoolInfo.lockKey(), name, config.MaxConcurrentPoolRollouts, timeout)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		defer release()
+		timeout -= time.Since(startTime)
+
+		kube, err := config.NewKubernetesClient(nodePoolInfo, userAgent)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		releaseLease, err := clusterRolloutLeases.acquire(nodePoolInfo.lockKey(), kube)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		defer releaseLease()
 	}
 
 	d.Partial(true)
-	if err := nodePoolUpdate(d, meta, nodePoolInfo, "", d.Timeout(schema.TimeoutUpdate)); err != nil {
-		return err
+	var warnings, plan []string
+	if d.Get("rollout_strategy").(string) == rolloutStrategyGKESurge {
+		warnings, plan, err = nodePoolSurgeUpdate(d, meta, nodePoolInfo, "", timeout)
+	} else {
+		warnings, plan, err = nodePoolUpdate(d, meta, nodePoolInfo, "", timeout)
+	}
+	diags := append(nodePoolDryRunPlan(name, plan), nodePoolRolloutWarnings(name, warnings)...)
+	if err != nil {
+		return append(diags, diag.FromErr(err)...)
 	}
 	d.Partial(false)
 
 	_, err = containerNodePoolAwaitRestingState(config, nodePoolInfo.fullyQualifiedName(name), nodePoolInfo.project, userAgent, d.Timeout(schema.TimeoutUpdate))
 	if err != nil {
-		return err
+		return append(diags, diag.FromErr(err)...)
+	}
+
+	if err := resourceContainerNodePoolRead(d, meta); err != nil {
+		return append(diags, diag.FromErr(err)...)
+	}
+
+	return append(diags, nodePoolZoneDivergence(name, d)...)
+}
+
+// nodePoolRolloutWarnings reports the warnings collected while rolling the
+// node pool as a single warning diagnostic.
+func nodePoolRolloutWarnings(name string, warnings []string) diag.Diagnostics {
+	if len(warnings) == 0 {
+		return nil
+	}
+
+	return diag.Diagnostics{
+		{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("NodePool %s was rolled with %d warnings", name, len(warnings)),
+			Detail:   strings.Join(warnings, "\n"),
+		},
+	}
+}
+
+// nodePoolDryRunPlan reports the steps of a dry run as a single warning
+// diagnostic.
+func nodePoolDryRunPlan(name string, plan []string) diag.Diagnostics {
+	if len(plan) == 0 {
+		return nil
 	}
 
-	return resourceContainerNodePoolRead(d, meta)
+	return diag.Diagnostics{
+		{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Dry run: NodePool %s was not changed", name),
+			Detail:   strings.Join(plan, "\n"),
+		},
+	}
 }
 
 func resourceContainerNodePoolDelete(d *schema.ResourceData, meta interface{}) error {
@@ -451,14 +559,92 @@ func resourceContainerNodePoolDelete(d *schema.ResourceData, meta interface{}) e
 		}
 	}
 
+	if err := containerNodePoolDelete(config, nodePoolInfo, name, userAgent, d.Timeout(schema.TimeoutDelete)); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] GKE NodePool %s has been deleted", d.Id())
+
+	d.SetId("")
+
+	return nil
+}
+
+// containerNodePoolOperationError is returned by containerNodePoolCreate when
+// the create call was accepted but the resulting operation failed.
+type containerNodePoolOperationError struct {
+	err error
+}
+
+func (e *containerNodePoolOperationError) Error() string {
+	return e.err.Error()
+}
+
+// containerNodePoolCreate issues the create call for the given node pool and
+// waits for the resulting operation to finish.
+func containerNodePoolCreate(config *Config, nodePoolInfo *NodePoolInformation, nodePool *containerBeta.NodePool, userAgent string, timeout time.Duration) error {
+	mutexKV.Lock(nodePoolInfo.lockKey())
+	defer mutexKV.Unlock(nodePoolInfo.lockKey())
+	defer config.invalidateNodePool(nodePoolInfo.fullyQualifiedName(nodePool.Name))
+
+	req := &containerBeta.CreateNodePoolRequest{
+		NodePool: nodePool,
+	}
+
+	startTime := time.Now()
+
+	var operation *containerBeta.Operation
+	err := resource.Retry(timeout, func() *resource.RetryError {
+		var err error
+		clusterNodePoolsCreateCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Create(nodePoolInfo.parent(), req)
+		if config.UserProjectOverride {
+			clusterNodePoolsCreateCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
+		}
+		operation, err = clusterNodePoolsCreateCall.Do()
+
+		if err != nil {
+			if isFailedPreconditionError(err) {
+				// We get failed precondition errors if the cluster is updating
+				// while we try to add the node pool.
+				return resource.RetryableError(err)
+			}
+			return resource.NonRetryableError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error creating NodePool: %s", err)
+	}
+	timeout -= time.Since(startTime)
+
+	waitErr := containerOperationWait(
+		config,
+		operation,
+		nodePoolInfo.project,
+		nodePoolInfo.location,
+		"creating GKE NodePool",
+		userAgent,
+		timeout,
+	)
+	if waitErr != nil {
+		return &containerNodePoolOperationError{err: waitErr}
+	}
+
+	return nil
+}
+
+// containerNodePoolDelete issues the delete call for the named node pool and
+// waits for the resulting operation to finish.
+func containerNodePoolDelete(config *Config, nodePoolInfo *NodePoolInformation, name, userAgent string, timeout time.Duration) error {
 	mutexKV.Lock(nodePoolInfo.lockKey())
 	defer mutexKV.Unlock(nodePoolInfo.lockKey())
+	defer config.invalidateNodePool(nodePoolInfo.fullyQualifiedName(name))
 
-	timeout := d.Timeout(schema.TimeoutDelete)
 	startTime := time.Now()
 
 	var operation *containerBeta.Operation
-	err = resource.Retry(timeout, func() *resource.RetryError {
+	err := resource.Retry(timeout, func() *resource.RetryError {
+		var err error
 		clusterNodePoolsDeleteCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Delete(nodePoolInfo.fullyQualifiedName(name))
 		if config.UserProjectOverride {
 			clusterNodePoolsDeleteCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
@@ -484,16 +670,48 @@ func resourceContainerNodePoolDelete(d *schema.ResourceData, meta interface{}) e
 	timeout -= time.Since(startTime)
 
 	// Wait until it's deleted
-	waitErr := containerOperationWait(config, operation, nodePoolInfo.project, nodePoolInfo.location, "deleting GKE NodePool", userAgent, timeout)
-	if waitErr != nil {
-		return waitErr
+	return containerOperationWait(config, operation, nodePoolInfo.project, nodePoolInfo.location, "deleting GKE NodePool", userAgent, timeout)
+}
+
+// containerNodePoolSetSize resizes every instance group of the named node
+// pool to nodeCount nodes and waits for the resize to finish.
+func containerNodePoolSetSize(config *Config, nodePoolInfo *NodePoolInformation, name string, nodeCount int64, userAgent string, timeout time.Duration) error {
+	mutexKV.Lock(nodePoolInfo.lockKey())
+	defer mutexKV.Unlock(nodePoolInfo.lockKey())
+	defer config.invalidateNodePool(nodePoolInfo.fullyQualifiedName(name))
+
+	req := &containerBeta.SetNodePoolSizeRequest{
+		NodeCount:       nodeCount,
+		ForceSendFields: []string{"NodeCount"},
 	}
 
-	log.Printf("[INFO] GKE NodePool %s has been deleted", d.Id())
+	startTime := time.Now()
 
-	d.SetId("")
+	var operation *containerBeta.Operation
+	err := resource.Retry(timeout, func() *resource.RetryError {
+		var err error
+		clusterNodePoolsSetSizeCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.SetSize(nodePoolInfo.fullyQualifiedName(name), req)
+		if config.UserProjectOverride {
+			clusterNodePoolsSetSizeCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
+		}
+		operation, err = clusterNodePoolsSetSizeCall.Do()
 
-	return nil
+		if err != nil {
+			if isFailedPreconditionError(err) {
+				// We get failed precondition errors if the cluster is updating
+				// while we try to resize the node pool.
+				return resource.RetryableError(err)
+			}
+			return resource.NonRetryableError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error resizing NodePool %s: %s", name, err)
+	}
+	timeout -= time.Since(startTime)
+
+	return containerOperationWait(config, operation, nodePoolInfo.project, nodePoolInfo.location, "resizing GKE NodePool", userAgent, timeout)
 }
 
 func resourceContainerNodePoolExists(d *schema.ResourceData, meta interface{}) (bool, error) {
@@ -509,11 +727,7 @@ func resourceContainerNodePoolExists(d *schema.ResourceData, meta interface{}) (
 	}
 
 	name := getNodePoolName(d.Id())
-	clusterNodePoolsGetCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Get(nodePoolInfo.fullyQualifiedName(name))
-	if config.UserProjectOverride {
-		clusterNodePoolsGetCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
-	}
-	_, err = clusterNodePoolsGetCall.Do()
+	_, err = config.getNodePool(nodePoolInfo.fullyQualifiedName(name), nodePoolInfo.project, userAgent)
 
 	if err != nil {
 		if err = handleNotFoundError(err, d, fmt.Sprintf("Container NodePool %s", name)); err == nil {
@@ -525,6 +739,96 @@ func resourceContainerNodePoolExists(d *schema.ResourceData, meta interface{}) (
 	return true, nil
 }
 
+// The ID formats accepted by terraform import, most specific first.
+var containerNodePoolImportIdRegexps = []*regexp.Regexp{
+	regexp.MustCompile("^projects/(?P<project>[^/]+)/locations/(?P<location>[^/]+)/clusters/(?P<cluster>[^/]+)/nodePools/(?P<name>[^/]+)$"),
+	regexp.MustCompile("^(?P<project>[^/]+)/(?P<location>[^/]+)/(?P<cluster>[^/]+)/(?P<name>[^/]+)$"),
+	regexp.MustCompile("^(?P<location>[^/]+)/(?P<cluster>[^/]+)/(?P<name>[^/]+)$"),
+}
+
+func resourceContainerNodePoolStateImporter(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	config := meta.(*Config)
+	userAgent, err := generateUserAgentString(d, config.userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	var re *regexp.Regexp
+	for _, re = range containerNodePoolImportIdRegexps {
+		if matches = re.FindStringSubmatch(d.Id()); matches != nil {
+			break
+		}
+	}
+	if matches == nil {
+		return nil, fmt.Errorf("Import id %q doesn't match any of the accepted formats: projects/{{project}}/locations/{{location}}/clusters/{{cluster}}/nodePools/{{name}}, {{project}}/{{location}}/{{cluster}}/{{name}}, {{location}}/{{cluster}}/{{name}}", d.Id())
+	}
+	for i, field := range re.SubexpNames() {
+		if field == "" {
+			continue
+		}
+		if err := d.Set(field, matches[i]); err != nil {
+			return nil, fmt.Errorf("Error setting %s: %s", field, err)
+		}
+	}
+
+	name := d.Get("name").(string)
+	nodePoolInfo, err := extractNodePoolInformation(d, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Set("project", nodePoolInfo.project); err != nil {
+		return nil, fmt.Errorf("Error setting project: %s", err)
+	}
+	d.SetId(nodePoolInfo.fullyQualifiedName(name))
+
+	nodePool, err := config.getNodePool(d.Id(), nodePoolInfo.project, userAgent)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading NodePool %s: %s", name, err)
+	}
+	if nodePool.Config != nil && nodePool.Config.Labels[temporaryNodePoolLabel] != "" {
+		return nil, fmt.Errorf("NodePool %s carries the %s label of a rollgcp temporary node pool and cannot be imported", name, temporaryNodePoolLabel)
+	}
+	if temporary, err := isTemporaryNodePool(config, nodePoolInfo, name, userAgent); err != nil {
+		return nil, err
+	} else if temporary {
+		return nil, fmt.Errorf("NodePool %s is named like a rollgcp temporary node pool and cannot be imported", name)
+	}
+
+	if _, err := containerNodePoolAwaitRestingState(config, d.Id(), nodePoolInfo.project, userAgent, d.Timeout(schema.TimeoutCreate)); err != nil {
+		return nil, err
+	}
+
+	return []*schema.ResourceData{d}, nil
+}
+
+// isTemporaryNodePool reports whether the name is that of the temporary node
+// pool of another pool of the cluster, or the legacy shared name, for
+// temporary pools created before they were labeled.
+func isTemporaryNodePool(config *Config, nodePoolInfo *NodePoolInformation, name, userAgent string) (bool, error) {
+	if name == legacyTemporaryNodePoolName {
+		return true, nil
+	}
+	if !strings.HasPrefix(name, temporaryNodePoolName("")) {
+		return false, nil
+	}
+
+	clusterNodePoolsListCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.List(nodePoolInfo.parent())
+	if config.UserProjectOverride {
+		clusterNodePoolsListCall.Header().Add("X-Goog-User-Project", nodePoolInfo.project)
+	}
+	resp, err := clusterNodePoolsListCall.Do()
+	if err != nil {
+		return false, fmt.Errorf("Error listing NodePools of cluster %s: %s", nodePoolInfo.cluster, err)
+	}
+	for _, np := range resp.NodePools {
+		if np.Name != name && temporaryNodePoolName(np.Name) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func expandNodePool(d *schema.ResourceData, prefix string) (*containerBeta.NodePool, error) {
 	var name string
 	if v, ok := d.GetOk(prefix + "name"); ok {
@@ -591,20 +895,28 @@ func expandNodePool(d *schema.ResourceData, prefix string) (*containerBeta.NodeP
 		}
 	}
 
-	if v, ok := d.GetOk(prefix + "upgrade_settings"); ok {
-		upgradeSettingsConfig := v.([]interface{})[0].(map[string]interface{})
-		np.UpgradeSettings = &containerBeta.UpgradeSettings{}
+	np.UpgradeSettings = expandUpgradeSettings(d, prefix)
 
-		if v, ok := upgradeSettingsConfig["max_surge"]; ok {
-			np.UpgradeSettings.MaxSurge = int64(v.(int))
-		}
+	return np, nil
+}
 
-		if v, ok := upgradeSettingsConfig["max_unavailable"]; ok {
-			np.UpgradeSettings.MaxUnavailable = int64(v.(int))
-		}
+func expandUpgradeSettings(d *schema.ResourceData, prefix string) *containerBeta.UpgradeSettings {
+	v, ok := d.GetOk(prefix + "upgrade_settings")
+	if !ok {
+		return nil
 	}
+	upgradeSettingsConfig := v.([]interface{})[0].(map[string]interface{})
+	upgradeSettings := &containerBeta.UpgradeSettings{}
 
-	return np, nil
+	if v, ok := upgradeSettingsConfig["max_surge"]; ok {
+		upgradeSettings.MaxSurge = int64(v.(int))
+	}
+
+	if v, ok := upgradeSettingsConfig["max_unavailable"]; ok {
+		upgradeSettings.MaxUnavailable = int64(v.(int))
+	}
+
+	return upgradeSettings
 }
 
 func flattenNodePool(d *schema.ResourceData, config *Config, np *containerBeta.NodePool, prefix string) (map[string]interface{}, error) {
@@ -616,22 +928,19 @@ func flattenNodePool(d *schema.ResourceData, config *Config, np *containerBeta.N
 	// Node pools don't expose the current node count in their API, so read the
 	// instance groups instead. They should all have the same size, but in case a resize
 	// failed or something else strange happened, we'll just use the average size.
+	// (InstanceGroupUrls are actually URLs for InstanceGroupManagers)
+	igms, err := nodePoolInstanceGroupManagers(config, np.InstanceGroupUrls, userAgent)
+	if err != nil {
+		return nil, err
+	}
 	size := 0
 	igmUrls := []string{}
 	for _, url := range np.InstanceGroupUrls {
-		// retrieve instance group manager (InstanceGroupUrls are actually URLs for InstanceGroupManagers)
-		matches := instanceGroupManagerURL.FindStringSubmatch(url)
-		if len(matches) < 4 {
-			return nil, fmt.Errorf("Error reading instance group manage URL '%q'", url)
-		}
-		igm, err := config.NewComputeBetaClient(userAgent).InstanceGroupManagers.Get(matches[1], matches[2], matches[3]).Do()
-		if isGoogleApiErrorWithCode(err, 404) {
+		igm, ok := igms[url]
+		if !ok {
 			// The IGM URL in is stale; don't include it
 			continue
 		}
-		if err != nil {
-			return nil, fmt.Errorf("Error reading instance group manager returned as an instance group URL: %q", err)
-		}
 		size += int(igm.TargetSize)
 		igmUrls = append(igmUrls, url)
 	}
@@ -645,9 +954,15 @@ func flattenNodePool(d *schema.ResourceData, config *Config, np *containerBeta.N
 		"initial_node_count":  np.InitialNodeCount,
 		"node_locations":      schema.NewSet(schema.HashString, convertStringArrToInterface(np.Locations)),
 		"node_count":          nodeCount,
+		"zonal_node_counts":   flattenZonalNodeCounts(igms),
 		"node_config":         flattenNodeConfig(np.Config),
 		"instance_group_urls": igmUrls,
 		"version":             np.Version,
+		"status":              np.Status,
+		"status_message":      np.StatusMessage,
+		"conditions":          flattenNodePoolConditions(np.Conditions),
+		"self_link":           np.SelfLink,
+		"pod_ipv4_cidr_size":  np.PodIpv4CidrSize,
 	}
 
 	if np.Autoscaling != nil {
@@ -688,65 +1003,99 @@ func flattenNodePool(d *schema.ResourceData, config *Config, np *containerBeta.N
 	return nodePool, nil
 }
 
-func nodePoolUpdate(d *schema.ResourceData, meta interface{}, nodePoolInfo *NodePoolInformation, prefix string, timeout time.Duration) error {
-	var err error
+// flattenNodePoolConditions flattens the node pool's status conditions.
+func flattenNodePoolConditions(conditions []*containerBeta.StatusCondition) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	for _, condition := range conditions {
+		result = append(result, map[string]interface{}{
+			"code":           condition.Code,
+			"canonical_code": condition.CanonicalCode,
+			"message":        condition.Message,
+		})
+	}
+	return result
+}
+
+// describeNodePoolConditions formats the node pool's status conditions for
+// use in error messages.
+func describeNodePoolConditions(conditions []*containerBeta.StatusCondition) string {
+	if len(conditions) == 0 {
+		return "no conditions"
+	}
+
+	described := make([]string, 0, len(conditions))
+	for _, condition := range conditions {
+		code := condition.Code
+		if code == "" {
+			code = condition.CanonicalCode
+		}
+		described = append(described, fmt.Sprintf("%s: %s", code, condition.Message))
+	}
+	return "conditions: " + strings.Join(described, "; ")
+}
+
+// nodePoolUpdate rolls the node pool to its new configuration. It returns the
+// warnings collected along the way, even if the rollout failed.
+func nodePoolUpdate(d *schema.ResourceData, meta interface{}, nodePoolInfo *NodePoolInformation, prefix string, timeout time.Duration) (warnings, plan []string, err error) {
+	config := meta.(*Config)
+	userAgent, err := generateUserAgentString(d, config.userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	name := getNodePoolName(d.Id())
 
 	log.Printf("[INFO] GKE NodePool %s is being updated", name)
 
-	tmpName := "temp-node-pool"
-
 	// This needs to be set to prevent errors about both initial node count and node count being set.
 	d.Set(prefix+"initial_node_count", 0)
-	d.SetId(getNodePoolIdHead(d.Id()) + "/" + tmpName)
-	err = d.Set(prefix+"name", tmpName)
+	nodePool, err := expandNodePool(d, prefix)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	nodePool.Name = name
 
-	err = resourceContainerNodePoolCreate(d, meta)
+	rollout, err := newNodePoolRollout(config, nodePoolInfo, name, userAgent, expandRolloutSettings(d.Get("rollout")), timeout)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// WAIT for transition
-	log.Printf("[INFO] GKE Pods are movign from NodePool %s to NodePool %s", name, tmpName)
+	if rollout.canary, err = expandCanarySettings(d.Get("canary")); err != nil {
+		return nil, nil, err
+	}
 
-	d.SetId(getNodePoolIdHead(d.Id()) + "/" + name)
-	d.Set(prefix+"initial_node_count", 0)
-	err = d.Set(prefix+"name", name)
-	if err != nil {
-		return err
+	if rollout.drain, err = expandDrainSettings(d.Get("drain")); err != nil {
+		return nil, nil, err
 	}
 
-	resourceContainerNodePoolDelete(d, meta)
+	rollout.pinnedWorkloadPolicy = d.Get("pinned_workload_policy").(string)
+	rollout.temporaryOverrides = expandTemporaryPoolOverrides(d)
+	rollout.fallbackZones = expandFallbackZones(d.Get("temporary_pool_fallback_zones"))
 
-	// Create new real node pool
-	err = resourceContainerNodePoolCreate(d, meta)
-	if err != nil {
-		return err
+	if nodePoolDryRun(d, config) {
+		plan, err := rollout.plan(nodePool)
+		return nil, plan, err
 	}
 
-	// WAIT for transition
-	log.Printf("[INFO] GKE Pods are moving from NodePool %s to NodePool %s", tmpName, name)
-
-	// destroy old tmp node pool
-	d.SetId(getNodePoolIdHead(d.Id()) + "/" + tmpName)
-	err = d.Set(prefix+"name", tmpName)
-	if err != nil {
-		return err
+	if err := rollout.run(nodePool); err != nil {
+		return rollout.warnings, nil, err
 	}
 
-	resourceContainerNodePoolDelete(d, meta)
+	log.Printf("[INFO] GKE NodePool %s has been updated", name)
 
-	d.SetId(getNodePoolIdHead(d.Id()) + "/" + name)
-	err = d.Set(prefix+"name", name)
-	if err != nil {
-		return err
-	}
+	return rollout.warnings, nil, nil
+}
 
-	return nil
+// nodePoolRollRequired reports whether any attribute of the node pool itself
+// changed. Changes to settings that only control how the pool is rolled are
+// saved to state without touching the live pool.
+func nodePoolRollRequired(d *schema.ResourceData) bool {
+	for k := range schemaNodePool {
+		if d.HasChange(k) {
+			return true
+		}
+	}
+	return false
 }
 
 func getNodePoolName(id string) string {
@@ -773,28 +1122,34 @@ var containerNodePoolRestingStates = RestingStates{
 // takes in a config object, full node pool name, project name and the current CRUD action timeout
 // returns a state with no error if the state is a resting state, and the last state with an error otherwise
 func containerNodePoolAwaitRestingState(config *Config, name, project, userAgent string, timeout time.Duration) (state string, err error) {
-	err = resource.Retry(timeout, func() *resource.RetryError {
-		clusterNodePoolsGetCall := config.NewContainerBetaClient(userAgent).Projects.Locations.Clusters.NodePools.Get(name)
-		if config.UserProjectOverride {
-			clusterNodePoolsGetCall.Header().Add("X-Goog-User-Project", project)
-		}
-		nodePool, gErr := clusterNodePoolsGetCall.Do()
+	err = pollWithBackoff(config, timeout, func() (float64, *resource.RetryError) {
+		nodePool, gErr := config.refreshNodePool(name, project, userAgent)
 		if gErr != nil {
-			return resource.NonRetryableError(gErr)
+			return -1, resource.NonRetryableError(gErr)
 		}
 
 		state = nodePool.Status
 		switch stateType := containerNodePoolRestingStates[state]; stateType {
 		case ReadyState:
 			log.Printf("[DEBUG] NodePool %q has status %q with message %q.", name, state, nodePool.StatusMessage)
-			return nil
+			return -1, nil
 		case ErrorState:
-			log.Printf("[DEBUG] NodePool %q has error state %q with message %q.", name, state, nodePool.StatusMessage)
-			return nil
+			log.Printf("[WARN] NodePool %q has error state %q with message %q and %s.", name, state, nodePool.StatusMessage, describeNodePoolConditions(nodePool.Conditions))
+			return -1, nil
 		default:
-			return resource.RetryableError(fmt.Errorf("NodePool %q has state %q with message %q", name, state, nodePool.StatusMessage))
+			return -1, resource.RetryableError(fmt.Errorf("NodePool %q has state %q with message %q and %s", name, state, nodePool.StatusMessage, describeNodePoolConditions(nodePool.Conditions)))
 		}
 	})
 
 	return state, err
 }
+
+// containerNodePoolErrorStateError reads the node pool found in an error
+// state and returns an error describing the state and its conditions.
+func containerNodePoolErrorStateError(config *Config, nodePoolInfo *NodePoolInformation, name, userAgent, state string) error {
+	nodePool, err := config.getNodePool(nodePoolInfo.fullyQualifiedName(name), nodePoolInfo.project, userAgent)
+	if err != nil {
+		return fmt.Errorf("NodePool %s was created in the error state %q", name, state)
+	}
+	return fmt.Errorf("NodePool %s was created in the error state %q with message %q and %s", name, nodePool.Status, nodePool.StatusMessage, describeNodePoolConditions(nodePool.Conditions))
+}
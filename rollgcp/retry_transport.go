@@ -36,8 +36,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httputil"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
@@ -46,14 +53,142 @@ import (
 
 const defaultRetryTransportTimeoutSec = 30
 
+// The bounds of the exponential backoff between attempts. Each wait is drawn
+// at random below the current bound (full jitter), so that requests failing
+// together do not retry together.
+const (
+	retryTransportBaseBackoff = 500 * time.Millisecond
+	retryTransportMaxBackoff  = 16 * time.Second
+)
+
+// retrySettings adjusts which errors the retryTransport retries and how
+// often.
+type retrySettings struct {
+	// codes replaces the HTTP status codes of isCommonRetryableErrorCode,
+	// if set.
+	codes []int
+	// maxAttempts caps the attempts per request, if above zero. Otherwise
+	// only the request context bounds them.
+	maxAttempts int
+}
+
 // NewTransportWithDefaultRetries constructs a default retryTransport that will retry common temporary errors
 func NewTransportWithDefaultRetries(t http.RoundTripper) *retryTransport {
+	return NewTransportWithRetrySettings(t, &retrySettings{})
+}
+
+// NewTransportWithRetrySettings constructs a retryTransport that retries the
+// common temporary errors as adjusted by settings.
+func NewTransportWithRetrySettings(t http.RoundTripper, settings *retrySettings) *retryTransport {
+	predicates := defaultErrorRetryPredicates
+	if len(settings.codes) > 0 {
+		// Keep in line with defaultErrorRetryPredicates.
+		predicates = []RetryErrorPredicateFunc{
+			isNetworkTemporaryError,
+			isNetworkTimeoutError,
+			isIoEOFError,
+			isConnectionResetNetworkError,
+			isRetryableErrorCodeIn(settings.codes),
+			is409OperationInProgressError,
+		}
+	}
 	return &retryTransport{
-		retryPredicates: defaultErrorRetryPredicates,
+		retryPredicates: predicates,
+		maxAttempts:     settings.maxAttempts,
+		counters:        newRetryCounters(),
 		internal:        t,
 	}
 }
 
+// isRetryableErrorCodeIn returns a predicate like isCommonRetryableErrorCode
+// for the given HTTP status codes.
+func isRetryableErrorCodeIn(codes []int) RetryErrorPredicateFunc {
+	return func(err error) (bool, string) {
+		gerr, ok := err.(*googleapi.Error)
+		if !ok {
+			return false, ""
+		}
+		for _, code := range codes {
+			if gerr.Code == code {
+				return true, fmt.Sprintf("Retryable error code %d", gerr.Code)
+			}
+		}
+		return false, ""
+	}
+}
+
+// retryCounters counts the retries of a transport by the predicate that
+// allowed them. Copies of the transport share them. Requests may carry
+// counters of their own in their context, see contextWithRetryCounters, to
+// count the retries of one operation apart from those running alongside it.
+// Nil counters count nothing.
+type retryCounters struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func newRetryCounters() *retryCounters {
+	return &retryCounters{counts: map[string]int{}}
+}
+
+func (c *retryCounters) add(predicate string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[predicate]++
+}
+
+// snapshot returns a copy of the counts.
+func (c *retryCounters) snapshot() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for k, v := range c.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+type retryCountersContextKey struct{}
+
+// contextWithRetryCounters returns ctx carrying c, for the requests made with
+// it to count their retries in.
+func contextWithRetryCounters(ctx context.Context, c *retryCounters) context.Context {
+	return context.WithValue(ctx, retryCountersContextKey{}, c)
+}
+
+func retryCountersFromContext(ctx context.Context) *retryCounters {
+	c, _ := ctx.Value(retryCountersContextKey{}).(*retryCounters)
+	return c
+}
+
+// retryCountingTransport puts counters in the context of each request, for
+// clients, such as those of the Google APIs, that do not pass a context down.
+type retryCountingTransport struct {
+	counters *retryCounters
+	internal http.RoundTripper
+}
+
+func (t *retryCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.internal.RoundTrip(req.WithContext(contextWithRetryCounters(req.Context(), t.counters)))
+}
+
+func (c *retryCounters) String() string {
+	counts := c.snapshot()
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, counts[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
 // Helper method to create a shallow copy of an HTTP client with a shallow-copied retryTransport
 // s.t. the base HTTP transport is the same (i.e. client connection pools are shared, retryPredicates are different)
 func ClientWithAdditionalRetries(baseClient *http.Client, predicates ...RetryErrorPredicateFunc) *http.Client {
@@ -73,6 +208,8 @@ func (t *retryTransport) WithAddedPredicates(predicates ...RetryErrorPredicateFu
 
 type retryTransport struct {
 	retryPredicates []RetryErrorPredicateFunc
+	maxAttempts     int
+	counters        *retryCounters
 	internal        http.RoundTripper
 }
 
@@ -94,8 +231,10 @@ func (t *retryTransport) RoundTrip(req *http.Request) (resp *http.Response, resp
 	}
 
 	attempts := 0
-	backoff := time.Millisecond * 500
-	nextBackoff := time.Millisecond * 500
+	backoff := retryTransportBaseBackoff
+	defer func() {
+		spanFromContext(req.Context()).setAttribute("rollgcp.http.attempts", attempts)
+	}()
 
 	// VCR depends on the original request body being consumed, so
 	// consume here. Since this won't affect the request itself,
@@ -124,7 +263,7 @@ Retry:
 		resp, respErr = t.internal.RoundTrip(newRequest)
 		attempts++
 
-		retryErr := t.checkForRetryableError(resp, respErr)
+		retryErr, predicate := t.checkForRetryableError(resp, respErr)
 		if retryErr == nil {
 			log.Printf("[DEBUG] Retry Transport: Stopping retries, last request was successful")
 			break Retry
@@ -133,19 +272,43 @@ Retry:
 			log.Printf("[DEBUG] Retry Transport: Stopping retries, last request failed with non-retryable error: %s", retryErr.Err)
 			break Retry
 		}
+		if t.maxAttempts > 0 && attempts >= t.maxAttempts {
+			log.Printf("[DEBUG] Retry Transport: Stopping retries, reached the maximum of %d attempts: %s", t.maxAttempts, retryErr.Err)
+			break Retry
+		}
+
+		// Full jitter, unless the server said when to come back.
+		wait := time.Duration(rand.Int63n(int64(backoff)))
+		if retryAfter, ok := retryAfterDelay(resp); ok {
+			wait = retryAfter
+			if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+				log.Printf("[DEBUG] Retry Transport: Stopping retries, Retry-After of %s is past the request deadline", wait)
+				break Retry
+			}
+		}
 
-		log.Printf("[DEBUG] Retry Transport: Waiting %s before trying request again", backoff)
+		t.counters.add(predicate)
+		retryCountersFromContext(req.Context()).add(predicate)
+		log.Printf("[DEBUG] Retry Transport: Retries so far by predicate: %s", t.counters)
+
+		log.Printf("[DEBUG] Retry Transport: Waiting %s before trying request again", wait)
 		select {
 		case <-ctx.Done():
 			log.Printf("[DEBUG] Retry Transport: Stopping retries, context done: %v", ctx.Err())
 			break Retry
-		case <-time.After(backoff):
-			log.Printf("[DEBUG] Retry Transport: Finished waiting %s before next retry", backoff)
+		case <-time.After(wait):
+			log.Printf("[DEBUG] Retry Transport: Finished waiting %s before next retry", wait)
+
+			// The response is discarded, so free its connection.
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
 
-			// Fibonnaci backoff - 0.5, 1, 1.5, 2.5, 4, 6.5, 10.5, ...
-			lastBackoff := backoff
-			backoff = backoff + nextBackoff
-			nextBackoff = lastBackoff
+			// Exponential backoff - 0.5, 1, 2, 4, 8, 16, 16, ...
+			backoff *= 2
+			if backoff > retryTransportMaxBackoff {
+				backoff = retryTransportMaxBackoff
+			}
 			continue
 		}
 	}
@@ -153,6 +316,40 @@ Retry:
 	return resp, respErr
 }
 
+// retryAfterDelay returns the wait a 429 or 503 response asks for in its
+// Retry-After header, given either in seconds or as an HTTP date.
+func retryAfterDelay(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(v); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retryPredicateName names the predicate for the retry counters.
+func retryPredicateName(pred RetryErrorPredicateFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(pred).Pointer()).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.TrimPrefix(name, "rollgcp.")
+	// Predicates built by a function are named after it.
+	if i := strings.Index(name, ".func"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
 // copyHttpRequest provides an copy of the given HTTP request for one RoundTrip.
 // If the request has a non-empty body (io.ReadCloser), the body is deep copied
 // so it can be consumed.
@@ -178,8 +375,9 @@ func copyHttpRequest(req *http.Request) (*http.Request, error) {
 
 // checkForRetryableError uses the googleapi.CheckResponse util to check for
 // errors in the response, and determines whether there is a retryable error.
-// in response/response error.
-func (t *retryTransport) checkForRetryableError(resp *http.Response, respErr error) *resource.RetryError {
+// in response/response error. For a retryable error, it also returns the name
+// of the predicate that matched.
+func (t *retryTransport) checkForRetryableError(resp *http.Response, respErr error) (*resource.RetryError, string) {
 	var errToCheck error
 
 	if respErr != nil {
@@ -194,7 +392,7 @@ func (t *retryTransport) checkForRetryableError(resp *http.Response, respErr err
 			// error code and messages in the response body.
 			dumpBytes, err := httputil.DumpResponse(resp, true)
 			if err != nil {
-				return resource.NonRetryableError(fmt.Errorf("unable to check response for error: %v", err))
+				return resource.NonRetryableError(fmt.Errorf("unable to check response for error: %v", err)), ""
 			}
 			respToCheck.Body = ioutil.NopCloser(bytes.NewReader(dumpBytes))
 		}
@@ -202,10 +400,10 @@ func (t *retryTransport) checkForRetryableError(resp *http.Response, respErr err
 	}
 
 	if errToCheck == nil {
-		return nil
+		return nil, ""
 	}
-	if isRetryableError(errToCheck, t.retryPredicates...) {
-		return resource.RetryableError(errToCheck)
+	if pred := matchRetryPredicates(errToCheck, t.retryPredicates); pred != nil {
+		return resource.RetryableError(errToCheck), retryPredicateName(pred)
 	}
-	return resource.NonRetryableError(errToCheck)
+	return resource.NonRetryableError(errToCheck), ""
 }
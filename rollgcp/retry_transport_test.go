@@ -0,0 +1,70 @@
+package rollgcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRetryCountersPerOperation(t *testing.T) {
+	// Each path fails with a 503 as many times as it names before it
+	// succeeds.
+	var lock sync.Mutex
+	calls := map[string]int{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures, _ := strconv.Atoi(r.URL.Path[1:])
+		lock.Lock()
+		calls[r.URL.Path]++
+		fail := calls[r.URL.Path] <= failures
+		lock.Unlock()
+		if fail {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer api.Close()
+
+	retryTransport := NewTransportWithDefaultRetries(http.DefaultTransport)
+	config := &Config{
+		client:  &http.Client{Transport: retryTransport},
+		context: context.Background(),
+	}
+	first, second := newRetryCounters(), newRetryCounters()
+	operations := []struct {
+		counters *retryCounters
+		path     string
+	}{
+		{first, "/1"},
+		{second, "/2"},
+	}
+
+	var wg sync.WaitGroup
+	for _, op := range operations {
+		wg.Add(1)
+		go func(client *http.Client, path string) {
+			defer wg.Done()
+			testRequest(t, client, context.Background(), api.URL+path)
+		}(config.withRetryCounters(op.counters).client, op.path)
+	}
+	wg.Wait()
+
+	total := func(c *retryCounters) int {
+		n := 0
+		for _, count := range c.snapshot() {
+			n += count
+		}
+		return n
+	}
+	if total(first) != 1 {
+		t.Errorf("expected 1 retry for the first operation, got %s", first)
+	}
+	if total(second) != 2 {
+		t.Errorf("expected 2 retries for the second operation, got %s", second)
+	}
+	if total(retryTransport.counters) != 3 {
+		t.Errorf("expected 3 retries of the transport in all, got %s", retryTransport.counters)
+	}
+}
@@ -39,16 +39,25 @@ func isRetryableError(topErr error, customPredicates ...RetryErrorPredicateFunc)
 		defaultErrorRetryPredicates,
 		customPredicates...)
 
+	return matchRetryPredicates(topErr, retryPredicates) != nil
+}
+
+// matchRetryPredicates returns the first of the predicates that dismisses
+// topErr, or an error it wraps, as retryable, or nil if none does.
+func matchRetryPredicates(topErr error, retryPredicates []RetryErrorPredicateFunc) RetryErrorPredicateFunc {
 	// Check all wrapped errors for a retryable error status.
-	isRetryable := false
+	var matched RetryErrorPredicateFunc
 	errwrap.Walk(topErr, func(werr error) {
+		if matched != nil {
+			return
+		}
 		for _, pred := range retryPredicates {
 			if predRetry, predReason := pred(werr); predRetry {
 				log.Printf("[DEBUG] Dismissed an error as retryable. %s - %s", predReason, werr)
-				isRetryable = true
+				matched = pred
 				return
 			}
 		}
 	})
-	return isRetryable
+	return matched
 }
@@ -0,0 +1,503 @@
+package rollgcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/terraform-provider-google-beta/version"
+)
+
+const defaultTelemetryServiceName = "terraform-provider-rollgcp"
+
+// How often finished spans are sent to the collector. Spans are also sent as
+// soon as a rollout ends.
+const telemetryExportInterval = 5 * time.Second
+
+// The kinds of span, as numbered by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+// telemetrySettings configures the export of traces to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding.
+type telemetrySettings struct {
+	// endpoint is the URL spans are posted to. Without one, nothing is
+	// traced.
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+}
+
+// expandProviderTelemetrySettings reads the telemetry block of the provider.
+// Whatever the block leaves out is taken from the standard OTEL_* variables.
+func expandProviderTelemetrySettings(v interface{}) *telemetrySettings {
+	settings := &telemetrySettings{
+		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
+		headers:     parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+	}
+	for k, v := range parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		settings.headers[k] = v
+	}
+	if os.Getenv("OTEL_SDK_DISABLED") != "true" && os.Getenv("OTEL_TRACES_EXPORTER") != "none" {
+		if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+			settings.endpoint = endpoint
+		} else if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+			settings.endpoint = otlpTracesURL(endpoint)
+		}
+	}
+
+	ls, _ := v.([]interface{})
+	if len(ls) > 0 && ls[0] != nil {
+		cfgV := ls[0].(map[string]interface{})
+		if endpoint, ok := cfgV["otlp_endpoint"]; ok && endpoint.(string) != "" {
+			settings.endpoint = otlpTracesURL(endpoint.(string))
+		}
+		if name, ok := cfgV["service_name"]; ok && name.(string) != "" {
+			settings.serviceName = name.(string)
+		}
+	}
+
+	if settings.serviceName == "" {
+		settings.serviceName = defaultTelemetryServiceName
+	}
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); settings.endpoint != "" && protocol != "" && protocol != "http/json" {
+		log.Printf("[WARN] OTEL_EXPORTER_OTLP_PROTOCOL is %q, but traces are only exported as http/json", protocol)
+	}
+
+	return settings
+}
+
+// otlpTracesURL returns the URL traces are posted to for the base URL of a
+// collector.
+func otlpTracesURL(base string) string {
+	return strings.TrimSuffix(base, "/") + "/v1/traces"
+}
+
+// parseOTLPHeaders parses headers in the key1=value1,key2=value2 form of
+// OTEL_EXPORTER_OTLP_HEADERS.
+func parseOTLPHeaders(v string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			value = strings.TrimSpace(kv[1])
+		}
+		headers[strings.TrimSpace(kv[0])] = value
+	}
+	return headers
+}
+
+// tracer records spans and sends them to the collector in batches. A nil
+// tracer records nothing, so callers need not check whether tracing is on.
+type tracer struct {
+	settings *telemetrySettings
+	client   *http.Client
+
+	lock    sync.Mutex
+	pending []*traceSpan
+	// active holds the phase spans of the rollouts in progress. See
+	// ambientParent.
+	active map[*traceSpan]bool
+}
+
+// newTracer returns a tracer for settings, or nil if tracing is off. Spans
+// are sent every telemetryExportInterval until ctx is done.
+func newTracer(ctx context.Context, settings *telemetrySettings) *tracer {
+	if settings == nil || settings.endpoint == "" {
+		return nil
+	}
+	log.Printf("[INFO] Exporting traces of service %s to %s", settings.serviceName, settings.endpoint)
+
+	t := &tracer{
+		settings: settings,
+		// Not the provider's own client, so that exporting spans is not
+		// itself traced.
+		client: &http.Client{
+			Transport: cleanhttp.DefaultPooledTransport(),
+			Timeout:   10 * time.Second,
+		},
+		active: map[*traceSpan]bool{},
+	}
+	go func() {
+		ticker := time.NewTicker(telemetryExportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.flush()
+			case <-ctx.Done():
+				t.flush()
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// start begins a span, in the trace of parent if there is one or else in a
+// new trace.
+func (t *tracer) start(parent *traceSpan, name string, kind int) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	s := &traceSpan{
+		tracer:     t,
+		spanID:     randomHex(8),
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return s
+}
+
+// startTrace begins the root span of a new trace that is sent as soon as the
+// span ends, rather than with the next periodic export. It is meant for
+// rollouts, whose traces should not wait on the process to keep running.
+func (t *tracer) startTrace(name string, kind int) *traceSpan {
+	s := t.start(nil, name, kind)
+	if s != nil {
+		s.flushOnEnd = true
+	}
+	return s
+}
+
+// activate marks s as the span of the rollout phase in progress.
+func (t *tracer) activate(s *traceSpan) {
+	if t == nil || s == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.active[s] = true
+}
+
+func (t *tracer) deactivate(s *traceSpan) {
+	if t == nil || s == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.active, s)
+}
+
+// ambientParent returns the span to parent a request to that carries none
+// in its context. The Google API clients do not pass a context down, so
+// their requests are attributed to the rollout phase in progress when there
+// is exactly one; otherwise they start traces of their own.
+func (t *tracer) ambientParent() *traceSpan {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.active) != 1 {
+		return nil
+	}
+	for s := range t.active {
+		return s
+	}
+	return nil
+}
+
+func (t *tracer) queue(s *traceSpan) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending = append(t.pending, s)
+}
+
+// flush sends the finished spans to the collector. Spans that fail to send
+// are dropped; tracing must never fail a rollout.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.export(spans))
+	if err != nil {
+		log.Printf("[WARN] Unable to encode %d spans: %s", len(spans), err)
+		return
+	}
+	req, err := http.NewRequest("POST", t.settings.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[WARN] Unable to export %d spans: %s", len(spans), err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.settings.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Printf("[WARN] Unable to export %d spans to %s: %s", len(spans), t.settings.endpoint, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("[WARN] Unable to export %d spans to %s: %s %s", len(spans), t.settings.endpoint, resp.Status, strings.TrimSpace(string(respBody)))
+		return
+	}
+	log.Printf("[TRACE] Exported %d spans to %s", len(spans), t.settings.endpoint)
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest, as far as it is
+// used here.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (t *tracer) export(spans []*traceSpan) *otlpTraces {
+	scope := otlpScopeSpans{
+		Scope: otlpScope{Name: "rollgcp", Version: version.ProviderVersion},
+	}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.export())
+	}
+	return &otlpTraces{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: otlpAttributes(map[string]interface{}{
+						"service.name": t.settings.serviceName,
+					}),
+				},
+				ScopeSpans: []otlpScopeSpans{scope},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attributes))
+	for k, v := range attributes {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: k, Value: value})
+	}
+	return encoded
+}
+
+// traceSpan is one timed operation of a trace. Its methods do nothing on a
+// nil span.
+type traceSpan struct {
+	tracer   *tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	// flushOnEnd sends the pending spans once the span ends. See startTrace.
+	flushOnEnd bool
+
+	lock       sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+func (s *traceSpan) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// finish ends the span, as failed if err is set. Spans started by startTrace
+// send their trace right away; the others are left to the periodic export, so
+// that requests made outside of rollouts never wait on the collector.
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if !s.end.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.lock.Unlock()
+
+	s.tracer.queue(s)
+	if s.flushOnEnd {
+		s.tracer.flush()
+	}
+}
+
+func (s *traceSpan) export() otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attributes),
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return span
+}
+
+type traceSpanContextKey struct{}
+
+// contextWithSpan returns ctx carrying s, for the requests made with it.
+func contextWithSpan(ctx context.Context, s *traceSpan) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceSpanContextKey{}, s)
+}
+
+func spanFromContext(ctx context.Context) *traceSpan {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(traceSpanContextKey{}).(*traceSpan)
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// Only uniqueness matters, so fall back to the clock.
+		now := time.Now().UnixNano()
+		for i := range b {
+			b[i] = byte(now >> (8 * uint(i%8)))
+		}
+	}
+	return hex.EncodeToString(b)
+}
+
+// tracingTransport records a client span for every request, carried in the
+// request's context so that the transports it wraps can annotate it.
+type tracingTransport struct {
+	tracer   *tracer
+	internal http.RoundTripper
+}
+
+// newTracingTransport wraps t with a span per request, unless tr is nil.
+func newTracingTransport(t http.RoundTripper, tr *tracer) http.RoundTripper {
+	if tr == nil {
+		return t
+	}
+	return &tracingTransport{tracer: tr, internal: t}
+}
+
+// RoundTrip implements the RoundTripper interface method.
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := spanFromContext(req.Context())
+	if parent == nil {
+		parent = t.tracer.ambientParent()
+	}
+	span := t.tracer.start(parent, req.Method+" "+req.URL.Host, spanKindClient)
+	span.setAttribute("http.request.method", req.Method)
+	span.setAttribute("server.address", req.URL.Host)
+	span.setAttribute("url.path", req.URL.Path)
+
+	resp, err := t.internal.RoundTrip(req.WithContext(contextWithSpan(req.Context(), span)))
+	if err == nil {
+		span.setAttribute("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 400 {
+			span.finish(fmt.Errorf("%s", resp.Status))
+			return resp, err
+		}
+	}
+	span.finish(err)
+	return resp, err
+}
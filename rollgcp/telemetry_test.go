@@ -0,0 +1,211 @@
+package rollgcp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testCollector is an OTLP/HTTP collector that keeps the spans posted to it.
+type testCollector struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	service string
+	spans   []otlpSpan
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Errorf("collector received invalid OTLP/JSON: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, rs := range traces.ResourceSpans {
+			c.service = otlpAttributeValue(rs.Resource.Attributes, "service.name")
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	return c
+}
+
+func (c *testCollector) received() []otlpSpan {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]otlpSpan{}, c.spans...)
+}
+
+func otlpAttributeValue(attributes []otlpAttribute, key string) string {
+	for _, a := range attributes {
+		if a.Key != key {
+			continue
+		}
+		for _, v := range a.Value {
+			return v.(string)
+		}
+	}
+	return ""
+}
+
+// newTestTracer returns a tracer exporting to the collector, and a client
+// whose requests it traces.
+func newTestTracer(t *testing.T, collector *testCollector) (*tracer, *http.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	tr := newTracer(ctx, &telemetrySettings{
+		endpoint:    collector.URL,
+		serviceName: "rollgcp-test",
+		headers:     map[string]string{},
+	})
+	client := &http.Client{
+		Transport: newTracingTransport(NewTransportWithDefaultRetries(http.DefaultTransport), tr),
+	}
+	return tr, client
+}
+
+func testRequest(t *testing.T, client *http.Client, ctx context.Context, url string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestTracerExportsRolloutTrace(t *testing.T) {
+	collector := newTestCollector(t)
+	defer collector.Close()
+
+	var lock sync.Mutex
+	calls := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lock.Lock()
+		calls++
+		first := calls == 1
+		lock.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	tr, client := newTestTracer(t, collector)
+	root := tr.startTrace("rollout pool", spanKindInternal)
+	phase := tr.start(root, "phase move-to-temporary", spanKindInternal)
+	ctx := contextWithSpan(context.Background(), phase)
+	testRequest(t, client, ctx, api.URL+"/ok")
+	testRequest(t, client, ctx, api.URL+"/missing")
+	phase.finish(nil)
+
+	if spans := collector.received(); len(spans) != 0 {
+		t.Fatalf("expected no spans before the rollout ended, got %d", len(spans))
+	}
+	root.finish(nil)
+
+	spans := collector.received()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans once the rollout ended, got %d: %+v", len(spans), spans)
+	}
+	if collector.service != "rollgcp-test" {
+		t.Errorf("expected service.name rollgcp-test, got %q", collector.service)
+	}
+
+	byPath := map[string]otlpSpan{}
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		if s.TraceID != root.traceID {
+			t.Errorf("span %s is in trace %s, expected %s", s.Name, s.TraceID, root.traceID)
+		}
+		byName[s.Name] = s
+		if path := otlpAttributeValue(s.Attributes, "url.path"); path != "" {
+			byPath[path] = s
+		}
+	}
+
+	if s := byName["rollout pool"]; s.ParentSpanID != "" {
+		t.Errorf("expected the rollout span to be the root, got parent %s", s.ParentSpanID)
+	}
+	if s := byName["phase move-to-temporary"]; s.ParentSpanID != root.spanID {
+		t.Errorf("expected the phase span's parent to be %s, got %s", root.spanID, s.ParentSpanID)
+	}
+
+	cases := []struct {
+		path       string
+		attempts   string
+		statusCode string
+		failed     bool
+	}{
+		{path: "/ok", attempts: "2", statusCode: "200"},
+		{path: "/missing", attempts: "1", statusCode: "404", failed: true},
+	}
+	for _, tc := range cases {
+		s, ok := byPath[tc.path]
+		if !ok {
+			t.Errorf("no span for %s", tc.path)
+			continue
+		}
+		if s.ParentSpanID != phase.spanID {
+			t.Errorf("expected the parent of %s to be the phase span %s, got %s", tc.path, phase.spanID, s.ParentSpanID)
+		}
+		if s.Kind != spanKindClient {
+			t.Errorf("expected %s to be a client span, got kind %d", tc.path, s.Kind)
+		}
+		if got := otlpAttributeValue(s.Attributes, "rollgcp.http.attempts"); got != tc.attempts {
+			t.Errorf("expected %s attempts for %s, got %q", tc.attempts, tc.path, got)
+		}
+		if got := otlpAttributeValue(s.Attributes, "http.response.status_code"); got != tc.statusCode {
+			t.Errorf("expected status code %s for %s, got %q", tc.statusCode, tc.path, got)
+		}
+		if failed := s.Status.Code == 2; failed != tc.failed {
+			t.Errorf("expected %s to have failed: %t, got status %+v", tc.path, tc.failed, s.Status)
+		}
+	}
+}
+
+func TestTracerDefersRequestTraces(t *testing.T) {
+	collector := newTestCollector(t)
+	defer collector.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer api.Close()
+
+	tr, client := newTestTracer(t, collector)
+	testRequest(t, client, context.Background(), api.URL+"/ok")
+
+	// A request outside of a rollout is a trace of its own, which must not
+	// be sent while the request returns.
+	if spans := collector.received(); len(spans) != 0 {
+		t.Fatalf("expected the request's span to wait for the periodic export, got %d spans", len(spans))
+	}
+
+	tr.flush()
+	spans := collector.received()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span after flushing, got %d", len(spans))
+	}
+	if spans[0].ParentSpanID != "" {
+		t.Errorf("expected the request's span to be a root, got parent %s", spans[0].ParentSpanID)
+	}
+	if got := otlpAttributeValue(spans[0].Attributes, "http.response.status_code"); got != "200" {
+		t.Errorf("expected status code 200, got %q", got)
+	}
+}
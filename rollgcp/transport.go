@@ -1,7 +1,49 @@
 package rollgcp
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
 )
 
 var DefaultRequestTimeout = 5 * time.Minute
+
+// newBaseTransport returns the transport that requests to Google APIs, and
+// for their tokens, go out on: through httpProxy if set, or else the proxy of
+// the environment, and trusting the PEM certificates of caBundle besides those
+// of the system, for proxies and private endpoints that present their own.
+func newBaseTransport(httpProxy, caBundle string) (*http.Transport, error) {
+	transport := cleanhttp.DefaultPooledTransport()
+
+	if httpProxy != "" {
+		proxyURL, err := url.Parse(httpProxy)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing http_proxy %q: %s", httpProxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if caBundle != "" {
+		contents, _, err := pathOrContents(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading ca_bundle: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			log.Printf("[WARN] Unable to load the system certificates, trusting only ca_bundle: %s", err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(contents)) {
+			return nil, fmt.Errorf("ca_bundle holds no PEM certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return transport, nil
+}